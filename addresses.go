@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	addressBouncing      = "bouncing"
+	addressUndeliverable = "undeliverable"
+)
+
+// addressStatus is what bounces have told us about one recipient address.
+type addressStatus struct {
+	Address        string      `json:"address"`
+	State          string      `json:"state"`
+	HardBounces    int         `json:"hard_bounces"`
+	SoftBounces    int         `json:"soft_bounces"`
+	SoftBounceAt   []time.Time `json:"soft_bounce_at,omitempty"`
+	LastBounceAt   time.Time   `json:"last_bounce_at"`
+	LastKind       string      `json:"last_kind"`
+	LastStatus     string      `json:"last_status,omitempty"`
+	LastDiagnostic string      `json:"last_diagnostic,omitempty"`
+	LastMessageID  string      `json:"last_message_id,omitempty"`
+}
+
+type addressRecord struct {
+	Op      string         `json:"op"`
+	Address string         `json:"address"`
+	Status  *addressStatus `json:"status,omitempty"`
+}
+
+// addressStore keeps per-address bounce state. A hard bounce, or softLimit
+// soft bounces within softWindow, marks an address undeliverable.
+type addressStore struct {
+	mu         sync.Mutex
+	journal    *journal
+	addresses  map[string]*addressStatus
+	softLimit  int
+	softWindow time.Duration
+}
+
+func openAddressStore(dir string, softLimit int, softWindow time.Duration) (*addressStore, error) {
+	s := &addressStore{addresses: make(map[string]*addressStatus), softLimit: softLimit, softWindow: softWindow}
+
+	j, err := openJournal(filepath.Join(dir, "addresses.log"), func(line []byte) error {
+		var r addressRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return err
+		}
+
+		switch r.Op {
+		case "put":
+			s.addresses[r.Address] = r.Status
+		case "reset":
+			delete(s.addresses, r.Address)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]any, 0, len(s.addresses))
+	for addr, st := range s.addresses {
+		records = append(records, addressRecord{Op: "put", Address: addr, Status: st})
+	}
+
+	if err := j.compact(records); err != nil {
+		j.close()
+		return nil, err
+	}
+
+	s.journal = j
+
+	return s, nil
+}
+
+func (s *addressStore) get(addr string) (addressStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.addresses[strings.ToLower(addr)]
+	if !ok {
+		return addressStatus{}, false
+	}
+
+	return *st, true
+}
+
+func (s *addressStore) recordBounce(r bouncedRecipient, messageID string, at time.Time) (addressStatus, error) {
+	addr := strings.ToLower(r.Address)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	updated := addressStatus{Address: addr}
+	if st, ok := s.addresses[addr]; ok {
+		updated = *st
+	}
+
+	// Soft bounces older than the window no longer count.
+	cutoff := at.Add(-s.softWindow)
+	recent := make([]time.Time, 0, len(updated.SoftBounceAt)+1)
+	for _, t := range updated.SoftBounceAt {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+
+	if r.Kind == bounceHard {
+		updated.HardBounces++
+	} else {
+		recent = append(recent, at)
+	}
+
+	updated.SoftBounceAt = recent
+	updated.SoftBounces = len(recent)
+
+	updated.LastBounceAt = at
+	updated.LastKind = r.Kind
+	updated.LastStatus = r.Status
+	updated.LastDiagnostic = r.Diagnostic
+	updated.LastMessageID = messageID
+
+	updated.State = addressBouncing
+	if updated.HardBounces > 0 || updated.SoftBounces >= s.softLimit {
+		updated.State = addressUndeliverable
+	}
+
+	if err := s.journal.append(addressRecord{Op: "put", Address: addr, Status: &updated}); err != nil {
+		return addressStatus{}, err
+	}
+
+	s.addresses[addr] = &updated
+
+	return updated, nil
+}
+
+// reset forgets the bounce history of an address.
+func (s *addressStore) reset(addr string) (bool, error) {
+	addr = strings.ToLower(addr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.addresses[addr]; !ok {
+		return false, nil
+	}
+
+	if err := s.journal.append(addressRecord{Op: "reset", Address: addr}); err != nil {
+		return false, err
+	}
+
+	delete(s.addresses, addr)
+
+	return true, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// apiKey is a client credential. Only the SHA-256 of the key is stored; it is
+// written as "sha256:<hex>" in the keys file.
+type apiKey struct {
+	Name          string   `json:"name"`
+	Hash          string   `json:"hash"`
+	Scopes        []string `json:"scopes"`
+	SenderDomains []string `json:"sender_domains"`
+}
+
+// allows reports whether the key grants scope. "*" grants everything and
+// "send:*" grants every template.
+func (k *apiKey) allows(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == "*" || s == scope {
+			return true
+		}
+		if s == "send:*" && strings.HasPrefix(scope, "send:") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsSender reports whether the key may send as addr. A key without
+// sender domains may only use the default sender.
+func (k *apiKey) allowsSender(addr string) bool {
+	domain := strings.ToLower(addr[strings.LastIndexByte(addr, '@')+1:])
+
+	for _, d := range k.SenderDomains {
+		if strings.ToLower(d) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+type apiKeys struct {
+	byHash map[string]*apiKey
+}
+
+func loadAPIKeys(path string) (*apiKeys, error) {
+	keys := &apiKeys{byHash: make(map[string]*apiKey)}
+
+	if path == "" {
+		return keys, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read api keys: %v", err)
+	}
+
+	var file struct {
+		Keys []*apiKey `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse api keys: %v", err)
+	}
+
+	for _, k := range file.Keys {
+		hash, ok := strings.CutPrefix(k.Hash, "sha256:")
+		if !ok || len(hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("api key %q: hash must be sha256:<hex>", k.Name)
+		}
+		keys.byHash[strings.ToLower(hash)] = k
+	}
+
+	return keys, nil
+}
+
+func (keys *apiKeys) enabled() bool {
+	return len(keys.byHash) > 0
+}
+
+func (keys *apiKeys) lookup(key string) (*apiKey, bool) {
+	sum := sha256.Sum256([]byte(key))
+	k, ok := keys.byHash[hex.EncodeToString(sum[:])]
+	return k, ok
+}
+
+// requireScope rejects requests without a valid API key in the
+// Authorization header, or whose key does not grant the scope returned by
+// scope. Authentication is only off with auth.disabled.
+func (app *application) requireScope(scope func(c echo.Context) string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if app.config.auth.disabled {
+				return next(c)
+			}
+
+			token, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if !ok || token == "" {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				return c.JSON(http.StatusUnauthorized, envelope{"error": "missing or malformed API key"})
+			}
+
+			key, ok := app.apiKeys.lookup(token)
+			if !ok {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				return c.JSON(http.StatusUnauthorized, envelope{"error": "invalid API key"})
+			}
+
+			if !key.allows(scope(c)) {
+				return c.JSON(http.StatusForbidden, envelope{"error": "API key is not allowed to use this endpoint"})
+			}
+
+			c.Set("apiKey", key)
+
+			return next(c)
+		}
+	}
+}
+
+func scope(name string) func(c echo.Context) string {
+	return func(c echo.Context) string { return name }
+}
+
+func templateScope(c echo.Context) string {
+	return "send:" + c.Param("template")
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	bounceHard = "hard"
+	bounceSoft = "soft"
+)
+
+var (
+	errNotBounce       = errors.New("message is not a bounce")
+	errUnmatchedBounce = errors.New("bounce does not match a message we sent")
+)
+
+type bouncedRecipient struct {
+	Address    string `json:"address"`
+	Action     string `json:"action,omitempty"`
+	Status     string `json:"status,omitempty"`
+	Diagnostic string `json:"diagnostic,omitempty"`
+	Kind       string `json:"kind"`
+}
+
+// bounceReport is what a bounce says about a message we sent. MessageID is
+// the Message-ID of the original message, without angle brackets, when the
+// bounce quotes it.
+type bounceReport struct {
+	MessageID  string             `json:"message_id,omitempty"`
+	Recipients []bouncedRecipient `json:"recipients"`
+}
+
+// bounceParts collects the pieces of a bounce that the parser looks at.
+type bounceParts struct {
+	status   []byte
+	text     []string
+	original []byte
+}
+
+// parseBounce reads an RFC 3464 delivery status notification or, failing
+// that, one of the common free-text formats sent by qmail, Exim, Postfix
+// and Exchange.
+func parseBounce(raw []byte) (*bounceReport, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNotBounce, err)
+	}
+
+	var parts bounceParts
+	if err := collectParts(textproto.MIMEHeader(m.Header), m.Body, &parts); err != nil {
+		return nil, fmt.Errorf("%w: %v", errNotBounce, err)
+	}
+
+	report := &bounceReport{MessageID: originalMessageID(parts)}
+
+	if parts.status != nil {
+		report.Recipients = parseDeliveryStatus(parts.status)
+	} else if looksLikeBounce(m.Header) {
+		report.Recipients = parseBounceText(strings.Join(parts.text, "\n"), m.Header.Get("X-Failed-Recipients"))
+	}
+
+	if len(report.Recipients) == 0 {
+		return nil, errNotBounce
+	}
+
+	return report, nil
+}
+
+func collectParts(header textproto.MIMEHeader, body io.Reader, parts *bounceParts) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := collectParts(p.Header, p, parts); err != nil {
+				return err
+			}
+		}
+	}
+
+	b, err := io.ReadAll(decodeTransfer(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return err
+	}
+
+	switch mediaType {
+	case "message/delivery-status", "message/global-delivery-status":
+		parts.status = b
+	case "message/rfc822", "text/rfc822-headers", "message/global", "message/global-headers":
+		if parts.original == nil {
+			parts.original = b
+		}
+	case "text/plain", "text/html":
+		if mediaType == "text/html" {
+			b = []byte(htmlToText(string(b)))
+		}
+		parts.text = append(parts.text, string(b))
+	}
+
+	return nil
+}
+
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &newlineStripper{r: r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
+
+// newlineStripper drops line breaks so that wrapped base64 decodes.
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (s *newlineStripper) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	j := 0
+	for _, c := range p[:n] {
+		if c != '\r' && c != '\n' {
+			p[j] = c
+			j++
+		}
+	}
+	return j, err
+}
+
+var messageIDHeader = regexp.MustCompile(`(?im)^Message-ID:\s*<([^>\s]+)>`)
+
+func originalMessageID(parts bounceParts) string {
+	sources := [][]byte{parts.original}
+	for _, t := range parts.text {
+		sources = append(sources, []byte(t))
+	}
+
+	for _, src := range sources {
+		if m := messageIDHeader.FindSubmatch(src); m != nil {
+			return string(m[1])
+		}
+	}
+
+	return ""
+}
+
+// parseDeliveryStatus reads the per-recipient groups of a
+// message/delivery-status body. The first group describes the message and
+// is skipped.
+func parseDeliveryStatus(b []byte) []bouncedRecipient {
+	rd := textproto.NewReader(bufio.NewReader(bytes.NewReader(b)))
+
+	var recipients []bouncedRecipient
+	for first := true; ; first = false {
+		fields, err := rd.ReadMIMEHeader()
+		if len(fields) > 0 && !first {
+			addr := fieldValue(fields.Get("Final-Recipient"))
+			if addr == "" {
+				addr = fieldValue(fields.Get("Original-Recipient"))
+			}
+
+			action := strings.ToLower(strings.TrimSpace(fields.Get("Action")))
+			if addr != "" && (action == "failed" || action == "delayed") {
+				r := bouncedRecipient{
+					Address:    strings.ToLower(addr),
+					Action:     action,
+					Status:     strings.TrimSpace(fields.Get("Status")),
+					Diagnostic: fieldValue(fields.Get("Diagnostic-Code")),
+				}
+				r.Kind = classifyBounce(r.Action, r.Status)
+				recipients = append(recipients, r)
+			}
+		}
+
+		if err != nil {
+			return recipients
+		}
+	}
+}
+
+// fieldValue strips the type prefix from values such as "rfc822; a@b".
+func fieldValue(v string) string {
+	if _, rest, ok := strings.Cut(v, ";"); ok {
+		v = rest
+	}
+	return strings.Trim(strings.TrimSpace(v), "<>")
+}
+
+var bounceSubjects = regexp.MustCompile(`(?i)undeliver|delivery (status|failure|has failed)|failure notice|returned mail|mail delivery (failed|system)|could not be delivered|delivery notification`)
+
+func looksLikeBounce(h mail.Header) bool {
+	if h.Get("X-Failed-Recipients") != "" {
+		return true
+	}
+
+	from := strings.ToLower(h.Get("From"))
+	if strings.Contains(from, "mailer-daemon") || strings.Contains(from, "postmaster") {
+		return true
+	}
+
+	return bounceSubjects.MatchString(h.Get("Subject"))
+}
+
+var (
+	// "<user@example.com>:" (qmail, Postfix) or an address alone on an
+	// indented line (Exim).
+	bounceAddressLine = regexp.MustCompile(`^(?:<([^<>\s]+@[^<>\s]+)>:|\s+([^<>\s:]+@[^<>\s:]+)\s*$)`)
+	enhancedStatus    = regexp.MustCompile(`(?:^|[^\d.])([245]\.\d{1,3}\.\d{1,3})(?:[^\d.]|$)`)
+	basicStatus       = regexp.MustCompile(`(?:^|[^\d.])([45])\d\d[ -]`)
+
+	// The start of the returned original message, past which addresses
+	// belong to the quoted message rather than the bounce.
+	returnedCopy = regexp.MustCompile(`(?i)copy of (the|your) (original )?message|original message (follows|below)|^-+\s*original message`)
+)
+
+// parseBounceText finds failed recipients in a free-text bounce. Each
+// recipient takes the status found in the lines that follow it.
+func parseBounceText(text, failedHeader string) []bouncedRecipient {
+	type block struct {
+		addr string
+		text strings.Builder
+	}
+
+	var blocks []*block
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		if returnedCopy.MatchString(line) {
+			break
+		}
+
+		if m := bounceAddressLine.FindStringSubmatch(line); m != nil {
+			b := &block{addr: m[1] + m[2]}
+			b.text.WriteString(line[len(m[0]):])
+			b.text.WriteString("\n")
+			blocks = append(blocks, b)
+			continue
+		}
+
+		if len(blocks) > 0 {
+			b := blocks[len(blocks)-1]
+			b.text.WriteString(line)
+			b.text.WriteString("\n")
+		}
+	}
+
+	if len(blocks) == 0 {
+		for _, addr := range strings.Split(failedHeader, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				b := &block{addr: addr}
+				b.text.WriteString(text)
+				blocks = append(blocks, b)
+			}
+		}
+	}
+
+	var recipients []bouncedRecipient
+	seen := make(map[string]bool)
+
+	for _, b := range blocks {
+		addr := strings.ToLower(b.addr)
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+
+		detail := strings.TrimSpace(b.text.String())
+
+		// The diagnostic is the line carrying the status, or the first line
+		// when there is none.
+		r := bouncedRecipient{Address: addr, Action: "failed", Diagnostic: firstLine(detail)}
+		if m := enhancedStatus.FindStringSubmatchIndex(detail); m != nil {
+			r.Status = detail[m[2]:m[3]]
+			r.Diagnostic = lineAt(detail, m[2])
+		} else if m := basicStatus.FindStringSubmatchIndex(detail); m != nil {
+			r.Status = detail[m[2]:m[3]] + ".0.0"
+			r.Diagnostic = lineAt(detail, m[2])
+		}
+
+		if strings.Contains(strings.ToLower(detail), "delayed") || strings.Contains(strings.ToLower(detail), "will keep trying") {
+			r.Action = "delayed"
+		}
+
+		r.Kind = classifyBounce(r.Action, r.Status)
+		recipients = append(recipients, r)
+	}
+
+	return recipients
+}
+
+func firstLine(s string) string {
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+// lineAt returns the trimmed line of s containing offset i.
+func lineAt(s string, i int) string {
+	start := strings.LastIndexByte(s[:i], '\n') + 1
+	end := strings.IndexByte(s[i:], '\n')
+	if end < 0 {
+		return strings.TrimSpace(s[start:])
+	}
+	return strings.TrimSpace(s[start : i+end])
+}
+
+// classifyBounce treats delays, 4.x.x statuses and full mailboxes as soft
+// bounces and every other failure as hard.
+func classifyBounce(action, status string) string {
+	switch {
+	case action == "delayed":
+		return bounceSoft
+	case strings.HasPrefix(status, "4."):
+		return bounceSoft
+	case status == "5.2.2":
+		return bounceSoft
+	default:
+		return bounceHard
+	}
+}
+
+// processBounce applies a bounce that quotes the Message-ID of a message we
+// sent, for the addresses that message went to. Anything else may be forged
+// and is only logged, returning errUnmatchedBounce. Addresses that become
+// undeliverable are added to the suppression list, and failed recipients
+// are reported to webhooks as bounced.
+func (app *application) processBounce(raw []byte) (*bounceReport, error) {
+	report, err := parseBounce(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	id := ""
+	if local, domain, ok := strings.Cut(report.MessageID, "@"); ok && strings.EqualFold(domain, app.config.mail.domain) {
+		id = local
+	}
+
+	sent, ok := app.statuses.get(id)
+	if id == "" || !ok {
+		slog.Warn("ignoring bounce for a message we did not send", "message_id", report.MessageID, "recipients", len(report.Recipients))
+		return report, errUnmatchedBounce
+	}
+
+	now := time.Now().UTC()
+
+	var failed, addrs []string
+	for _, r := range report.Recipients {
+		if !slices.ContainsFunc(sent.Recipients, func(to string) bool { return strings.EqualFold(to, r.Address) }) {
+			slog.Warn("ignoring bounce for an address the message was not sent to", "id", id, "address", r.Address)
+			continue
+		}
+
+		// A delay notice means the remote side is still trying; it says
+		// nothing yet about the address.
+		if r.Action == "delayed" {
+			slog.Info("delivery delayed", "id", id, "address", r.Address, "status", r.Status)
+			continue
+		}
+
+		st, err := app.addresses.recordBounce(r, id, now)
+		if err != nil {
+			return nil, err
+		}
+
+		slog.Warn("bounce received", "id", id, "address", r.Address, "kind", r.Kind, "status", r.Status, "state", st.State)
+
+		if st.State == addressUndeliverable {
+			if err := app.suppressBounced(st.Address, now); err != nil {
+				return nil, err
+			}
+		}
+
+		failed = append(failed, strings.TrimSpace(r.Address+": "+r.Status+" "+r.Diagnostic))
+		addrs = append(addrs, r.Address)
+	}
+
+	if len(failed) == 0 {
+		return report, nil
+	}
+
+	if _, err := app.statuses.mark(id, statusBounced, strings.Join(failed, "; ")); err != nil {
+		return nil, err
+	}
+
+	app.webhooks.dispatch(webhookEvent{
+		Event:      eventBounced,
+		MessageID:  id,
+		Recipients: addrs,
+		Response:   strings.Join(failed, "; "),
+		At:         now,
+	})
+
+	return report, nil
+}
+
+// suppressBounced suppresses an undeliverable address for
+// suppression.bounce_expiry, leaving any existing entry alone.
+func (app *application) suppressBounced(addr string, now time.Time) error {
+	if _, ok := app.suppressed.get(addr); ok {
+		return nil
+	}
+
+	var expiresAt *time.Time
+	if d := app.config.suppression.bounceExpiry; d > 0 {
+		t := now.Add(d)
+		expiresAt = &t
+	}
+
+	return app.suppressed.add(newSuppression(addr, reasonBounce, expiresAt))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// startBouncePollers starts the configured mailbox pollers. Each runs until
+// the process exits.
+func (app *application) startBouncePollers() {
+	interval := app.config.bounce.pollInterval
+
+	if app.config.bounce.maildir != "" {
+		go poll(interval, app.pollMaildir)
+	}
+
+	if app.config.bounce.imapAddr != "" {
+		go poll(interval, app.pollIMAP)
+	}
+}
+
+func poll(interval time.Duration, fn func() error) {
+	for {
+		if err := fn(); err != nil {
+			slog.Error("bounce poll failed", "error", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// pollMaildir processes every message in the maildir's new directory and
+// moves it to cur, marked seen. Messages that could not be recorded stay in
+// new for the next poll.
+func (app *application) pollMaildir() error {
+	dir := app.config.bounce.maildir
+
+	entries, err := os.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(dir, "new", e.Name())
+
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if !app.handlePolledBounce(raw, path) {
+			continue
+		}
+
+		if err := os.Rename(path, filepath.Join(dir, "cur", e.Name()+":2,S")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pollIMAP processes unseen messages in the bounce mailbox and marks them
+// seen once handled.
+func (app *application) pollIMAP() error {
+	cfg := app.config.bounce
+
+	c, err := dialIMAP(cfg.imapAddr, cfg.imapTLS)
+	if err != nil {
+		return err
+	}
+	defer c.logout()
+
+	if err := c.login(cfg.imapUser, cfg.imapPassword); err != nil {
+		return err
+	}
+
+	if err := c.selectMailbox(cfg.imapMailbox); err != nil {
+		return err
+	}
+
+	uids, err := c.unseen()
+	if err != nil {
+		return err
+	}
+
+	for _, uid := range uids {
+		raw, err := c.fetch(uid)
+		if err != nil {
+			return err
+		}
+
+		if !app.handlePolledBounce(raw, cfg.imapMailbox+"/"+uid) {
+			continue
+		}
+
+		if err := c.markSeen(uid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handlePolledBounce processes one polled message and reports whether it is
+// done with, which includes mail that turned out not to be a bounce.
+func (app *application) handlePolledBounce(raw []byte, source string) bool {
+	_, err := app.processBounce(raw)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errNotBounce):
+		slog.Info("ignoring message that is not a bounce", "source", source)
+		return true
+	case errors.Is(err, errUnmatchedBounce):
+		return true
+	default:
+		slog.Error("failed to process bounce", "source", source, "error", err)
+		return false
+	}
+}
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/gommon/bytes"
+	"gopkg.in/yaml.v3"
+
+	"mailer/internal/dkim"
+	"mailer/internal/mailmsg"
+)
+
+type config struct {
+	port int
+	env  string
+	mail struct {
+		host       string
+		port       string
+		user       string
+		pwd        string
+		auth       string
+		recipients string
+		transport  string
+		dir        string
+		from       string
+		fromName   string
+		replyTo    string
+		domain     string
+	}
+	relays  []relayConfig
+	routing map[string][]string
+
+	webhooks []webhookConfig
+	webhook  struct {
+		maxAttempts int
+		baseDelay   time.Duration
+		maxDelay    time.Duration
+		timeout     time.Duration
+		retention   time.Duration
+	}
+	breaker struct {
+		failures int
+		cooldown time.Duration
+	}
+	oauth struct {
+		tokenURL     string
+		clientID     string
+		clientSecret string
+		refreshToken string
+	}
+	tls struct {
+		mode       string
+		minVersion string
+		caFile     string
+		certFile   string
+		keyFile    string
+		serverName string
+	}
+	pool struct {
+		size        int
+		maxMessages int
+		idleTimeout time.Duration
+		timeout     time.Duration
+	}
+	mx struct {
+		port          string
+		helo          string
+		tls           string
+		greylistDelay time.Duration
+		timeout       time.Duration
+		hosts         string
+	}
+	suppression struct {
+		bounceExpiry time.Duration
+	}
+	bounce struct {
+		softLimit    int
+		softWindow   time.Duration
+		maildir      string
+		pollInterval time.Duration
+		imapAddr     string
+		imapTLS      string
+		imapUser     string
+		imapPassword string
+		imapMailbox  string
+	}
+	dkim struct {
+		headers  string
+		selector string
+		keyFile  string
+		keys     []dkimKeyConfig
+	}
+	queue struct {
+		dir     string
+		workers int
+	}
+	retry struct {
+		maxAttempts int
+		baseDelay   time.Duration
+		maxDelay    time.Duration
+	}
+	status struct {
+		retention time.Duration
+	}
+	templates struct {
+		dir    string
+		reload time.Duration
+	}
+	limits struct {
+		body        string
+		attachments string
+	}
+	auth struct {
+		keysFile string
+		disabled bool
+	}
+	ip struct {
+		admin          string
+		internal       string
+		trustedProxies string
+	}
+	signing struct {
+		secret string
+		window time.Duration
+	}
+	spam struct {
+		action           string
+		tokenSecret      string
+		minSubmit        time.Duration
+		captcha          string
+		captchaStubToken string
+		keywords         string
+		maxScore         int
+	}
+	ratelimit struct {
+		store         string
+		redisAddr     string
+		redisPassword string
+		redisDB       int
+		redisPool     int
+		ip            string
+		recipients    string
+	}
+}
+
+// setting ties a config value to its key in the config file, which is also
+// its command-line flag, and to the environment variable that overrides it.
+type setting struct {
+	key    string
+	env    string
+	secret bool
+}
+
+// configFlags registers every setting on a flag set bound to cfg.
+func configFlags(cfg *config) (*flag.FlagSet, []setting) {
+	fs := flag.NewFlagSet("mailer", flag.ContinueOnError)
+
+	var settings []setting
+
+	str := func(p *string, key, env, def, usage string) {
+		fs.StringVar(p, key, def, usage)
+		settings = append(settings, setting{key: key, env: env})
+	}
+	secret := func(p *string, key, env, usage string) {
+		fs.StringVar(p, key, "", usage)
+		settings = append(settings, setting{key: key, env: env, secret: true})
+	}
+	num := func(p *int, key, env string, def int, usage string) {
+		fs.IntVar(p, key, def, usage)
+		settings = append(settings, setting{key: key, env: env})
+	}
+	dur := func(p *time.Duration, key, env string, def time.Duration, usage string) {
+		fs.DurationVar(p, key, def, usage)
+		settings = append(settings, setting{key: key, env: env})
+	}
+	boolean := func(p *bool, key, env string, def bool, usage string) {
+		fs.BoolVar(p, key, def, usage)
+		settings = append(settings, setting{key: key, env: env})
+	}
+
+	num(&cfg.port, "server.port", "PORT", 0, "Port to listen on")
+	str(&cfg.env, "server.env", "ENV", "development", "Environment (development|production)")
+
+	str(&cfg.mail.host, "smtp.host", "EMAIL_HOST", "", "SMTP relay host")
+	str(&cfg.mail.port, "smtp.port", "EMAIL_PORT", "587", "SMTP relay port")
+	str(&cfg.mail.user, "smtp.user", "EMAIL_USER", "", "SMTP user")
+	secret(&cfg.mail.pwd, "smtp.password", "EMAIL_PASS", "SMTP password, or the access token for xoauth2 without a token URL")
+	str(&cfg.mail.auth, "smtp.auth", "SMTP_AUTH", smtpAuthPlain, "SMTP auth mechanism (none|plain|login|cram-md5|xoauth2)")
+	str(&cfg.oauth.tokenURL, "smtp.oauth_token_url", "SMTP_OAUTH_TOKEN_URL", "", "OAuth2 token endpoint used to refresh xoauth2 access tokens")
+	str(&cfg.oauth.clientID, "smtp.oauth_client_id", "SMTP_OAUTH_CLIENT_ID", "", "OAuth2 client ID")
+	secret(&cfg.oauth.clientSecret, "smtp.oauth_client_secret", "SMTP_OAUTH_CLIENT_SECRET", "OAuth2 client secret")
+	secret(&cfg.oauth.refreshToken, "smtp.oauth_refresh_token", "SMTP_OAUTH_REFRESH_TOKEN", "OAuth2 refresh token")
+	num(&cfg.breaker.failures, "smtp.breaker_failures", "SMTP_BREAKER_FAILURES", 3, "Consecutive failures before a relay is taken out of rotation")
+	dur(&cfg.breaker.cooldown, "smtp.breaker_cooldown", "SMTP_BREAKER_COOLDOWN", 30*time.Second, "How long a failing relay stays out of rotation")
+	str(&cfg.tls.mode, "smtp.tls", "SMTP_TLS", smtpTLSOpportunistic, "TLS mode (none|opportunistic|starttls-required|implicit)")
+	str(&cfg.tls.minVersion, "smtp.tls_min_version", "SMTP_TLS_MIN_VERSION", "1.2", "Minimum TLS version (1.0|1.1|1.2|1.3)")
+	str(&cfg.tls.caFile, "smtp.ca_file", "SMTP_CA_FILE", "", "PEM bundle of CAs trusted for the relay (defaults to the system roots)")
+	str(&cfg.tls.certFile, "smtp.cert_file", "SMTP_CERT_FILE", "", "Client certificate presented to the relay")
+	str(&cfg.tls.keyFile, "smtp.key_file", "SMTP_KEY_FILE", "", "Private key of the client certificate")
+	str(&cfg.tls.serverName, "smtp.server_name", "SMTP_SERVER_NAME", "", "Name expected in the relay certificate (defaults to smtp.host)")
+	num(&cfg.pool.size, "smtp.pool_size", "SMTP_POOL_SIZE", 4, "Maximum concurrent connections per relay")
+	num(&cfg.pool.maxMessages, "smtp.max_messages", "SMTP_MAX_MESSAGES", 100, "Messages sent over a connection before it is replaced")
+	dur(&cfg.pool.idleTimeout, "smtp.idle_timeout", "SMTP_IDLE_TIMEOUT", 30*time.Second, "How long an unused connection is kept open")
+	dur(&cfg.pool.timeout, "smtp.timeout", "SMTP_TIMEOUT", time.Minute, "Deadline for each phase of an SMTP session: setup, each message, reset and quit")
+
+	str(&cfg.mail.transport, "mail.transport", "EMAIL_TRANSPORT", "smtp", "Mail transport (smtp|mx|file|memory)")
+	str(&cfg.mail.dir, "mail.dir", "EMAIL_DIR", "", "Maildir used by the file transport")
+	str(&cfg.mail.from, "mail.from", "EMAIL_FROM", "", "Sender address (defaults to the SMTP user)")
+	str(&cfg.mail.fromName, "mail.from_name", "EMAIL_FROM_NAME", "Rent Management System", "Sender display name")
+	str(&cfg.mail.replyTo, "mail.reply_to", "EMAIL_REPLY_TO", "", "Default Reply-To address")
+	str(&cfg.mail.domain, "mail.domain", "EMAIL_DOMAIN", "", "Domain used in Message-ID headers (defaults to the sender domain)")
+
+	str(&cfg.mx.port, "mx.port", "MX_PORT", "25", "Port used when delivering directly to mail exchangers")
+	str(&cfg.mx.helo, "mx.helo", "MX_HELO", "", "Name sent in EHLO (defaults to mail.domain)")
+	str(&cfg.mx.tls, "mx.tls", "MX_TLS", smtpTLSOpportunistic, "TLS towards mail exchangers (none|opportunistic|starttls-required)")
+	dur(&cfg.mx.greylistDelay, "mx.greylist_delay", "MX_GREYLIST_DELAY", 5*time.Minute, "Minimum wait before retrying a domain that deferred the message")
+	dur(&cfg.mx.timeout, "mx.timeout", "MX_TIMEOUT", 5*time.Minute, "Deadline for each phase of a session with a mail exchanger")
+	str(&cfg.mx.hosts, "mx.hosts", "MX_HOSTS", "", "Exchangers used instead of DNS, as domain=host[:port] with hosts space-separated, comma-separated")
+
+	str(&cfg.dkim.headers, "dkim.headers", "DKIM_HEADERS", strings.Join(dkim.DefaultHeaders, ","), "Header fields covered by DKIM signatures")
+	str(&cfg.dkim.selector, "dkim.selector", "DKIM_SELECTOR", "mailer", "DKIM selector for mail.domain when no keys list is configured")
+	str(&cfg.dkim.keyFile, "dkim.key_file", "DKIM_KEY_FILE", "", "PEM private key (RSA or Ed25519) signing mail from mail.domain")
+
+	str(&cfg.mail.recipients, "contact.recipients", "RECEPIENTS", "", "Comma-separated recipients of the contact form")
+
+	str(&cfg.queue.dir, "queue.dir", "QUEUE_DIR", "data", "Directory holding the outbound queue")
+	num(&cfg.queue.workers, "queue.workers", "QUEUE_WORKERS", 4, "Number of queue workers")
+
+	num(&cfg.retry.maxAttempts, "retry.max_attempts", "RETRY_MAX_ATTEMPTS", 8, "Delivery attempts before a message is dead-lettered")
+	dur(&cfg.retry.baseDelay, "retry.base_delay", "RETRY_BASE_DELAY", 30*time.Second, "Delay before the first retry")
+	dur(&cfg.retry.maxDelay, "retry.max_delay", "RETRY_MAX_DELAY", time.Hour, "Upper bound on the retry delay")
+
+	dur(&cfg.status.retention, "status.retention", "STATUS_RETENTION", 7*24*time.Hour, "How long message status is kept")
+
+	num(&cfg.bounce.softLimit, "bounce.soft_limit", "BOUNCE_SOFT_LIMIT", 3, "Soft bounces within bounce.soft_window after which an address counts as undeliverable")
+	dur(&cfg.bounce.softWindow, "bounce.soft_window", "BOUNCE_SOFT_WINDOW", 7*24*time.Hour, "How long a soft bounce counts towards bounce.soft_limit")
+	str(&cfg.bounce.maildir, "bounce.maildir", "BOUNCE_MAILDIR", "", "Maildir polled for bounces")
+	dur(&cfg.bounce.pollInterval, "bounce.poll_interval", "BOUNCE_POLL_INTERVAL", time.Minute, "How often bounce mailboxes are polled")
+	str(&cfg.bounce.imapAddr, "bounce.imap_addr", "BOUNCE_IMAP_ADDR", "", "IMAP server (host:port) polled for bounces")
+	str(&cfg.bounce.imapTLS, "bounce.imap_tls", "BOUNCE_IMAP_TLS", "implicit", "TLS towards the IMAP server (implicit|none)")
+	str(&cfg.bounce.imapUser, "bounce.imap_user", "BOUNCE_IMAP_USER", "", "IMAP user")
+	secret(&cfg.bounce.imapPassword, "bounce.imap_password", "BOUNCE_IMAP_PASSWORD", "IMAP password")
+	str(&cfg.bounce.imapMailbox, "bounce.imap_mailbox", "BOUNCE_IMAP_MAILBOX", "INBOX", "IMAP mailbox holding bounces")
+
+	dur(&cfg.suppression.bounceExpiry, "suppression.bounce_expiry", "SUPPRESSION_BOUNCE_EXPIRY", 0, "How long addresses made undeliverable by bounces stay suppressed (0 keeps them until removed)")
+
+	num(&cfg.webhook.maxAttempts, "webhook.max_attempts", "WEBHOOK_MAX_ATTEMPTS", 10, "Attempts per webhook delivery before it is given up")
+	dur(&cfg.webhook.baseDelay, "webhook.base_delay", "WEBHOOK_BASE_DELAY", 10*time.Second, "Delay before the first webhook retry, doubled on each further retry")
+	dur(&cfg.webhook.maxDelay, "webhook.max_delay", "WEBHOOK_MAX_DELAY", time.Hour, "Longest delay between webhook retries")
+	dur(&cfg.webhook.timeout, "webhook.timeout", "WEBHOOK_TIMEOUT", 10*time.Second, "Timeout for one webhook request")
+	dur(&cfg.webhook.retention, "webhook.retention", "WEBHOOK_RETENTION", 7*24*time.Hour, "How long finished webhook deliveries are kept in the delivery log")
+
+	str(&cfg.templates.dir, "templates.dir", "TEMPLATES_DIR", "", "Directory with templates overriding the embedded ones")
+	dur(&cfg.templates.reload, "templates.reload", "TEMPLATES_RELOAD", 2*time.Second, "How often the templates directory is checked for changes")
+
+	str(&cfg.limits.body, "limits.body", "BODY_LIMIT", "2K", "Request body limit for JSON endpoints")
+	str(&cfg.limits.attachments, "limits.attachments", "ATTACHMENT_LIMIT", "10M", "Request body limit for endpoints accepting attachments")
+
+	str(&cfg.auth.keysFile, "auth.keys_file", "API_KEYS_FILE", "", "JSON file with hashed API keys")
+	boolean(&cfg.auth.disabled, "auth.disabled", "AUTH_DISABLED", false, "Accept requests without an API key (not allowed in production)")
+
+	secret(&cfg.signing.secret, "signing.secret", "SIGNING_SECRET", "Shared secret for HMAC-signed internal requests (empty disables signing)")
+	dur(&cfg.signing.window, "signing.window", "SIGNING_WINDOW", 5*time.Minute, "Allowed clock skew for signed requests")
+
+	str(&cfg.ip.admin, "ip.admin", "ALLOWED_IP", "", "IPs and CIDR ranges allowed to use the admin endpoints")
+	str(&cfg.ip.internal, "ip.internal", "INTERNAL_ALLOWED_IPS", "", "IPs and CIDR ranges allowed to use the internal endpoints (empty allows all)")
+	str(&cfg.ip.trustedProxies, "ip.trusted_proxies", "TRUSTED_PROXIES", "", "IPs and CIDR ranges of proxies whose X-Forwarded-For is trusted")
+
+	str(&cfg.spam.action, "spam.action", "SPAM_ACTION", spamActionDrop, "What to do with suspected spam (drop|flag|reject)")
+	secret(&cfg.spam.tokenSecret, "spam.token_secret", "SPAM_TOKEN_SECRET", "Secret used to sign contact form tokens (random when empty)")
+	dur(&cfg.spam.minSubmit, "spam.min_submit", "SPAM_MIN_SUBMIT", 0, "Minimum time between fetching a form token and submitting (0 disables tokens)")
+	str(&cfg.spam.captcha, "spam.captcha", "SPAM_CAPTCHA", "none", "Captcha provider (none|stub)")
+	secret(&cfg.spam.captchaStubToken, "spam.captcha_stub_token", "SPAM_CAPTCHA_STUB_TOKEN", "Token accepted by the stub captcha provider")
+	str(&cfg.spam.keywords, "spam.keywords", "SPAM_KEYWORDS", "", "Comma-separated keywords that raise the content score")
+	num(&cfg.spam.maxScore, "spam.max_score", "SPAM_MAX_SCORE", 6, "Highest content score accepted (0 disables scoring)")
+
+	str(&cfg.ratelimit.store, "ratelimit.store", "RATELIMIT_STORE", "memory", "Rate limit state store (memory|redis)")
+	str(&cfg.ratelimit.redisAddr, "ratelimit.redis_addr", "REDIS_ADDR", "", "Redis address for the redis rate limit store")
+	secret(&cfg.ratelimit.redisPassword, "ratelimit.redis_password", "REDIS_PASSWORD", "Redis password")
+	num(&cfg.ratelimit.redisDB, "ratelimit.redis_db", "REDIS_DB", 0, "Redis database number")
+	num(&cfg.ratelimit.redisPool, "ratelimit.redis_pool", "REDIS_POOL_SIZE", 10, "Most Redis connections open at once")
+	str(&cfg.ratelimit.ip, "ratelimit.ip", "IP_LIMIT", "30/3s", "Requests allowed per client IP as <count>/<window>")
+	str(&cfg.ratelimit.recipients, "ratelimit.recipients", "RECIPIENT_LIMITS", "pwdreset=3/1h,activate=3/1h,welcome=3/1h,completedreset=3/1h", "Per-recipient limits as <template>=<count>/<window>, comma-separated")
+
+	return fs, settings
+}
+
+// loadConfig builds the configuration from, in increasing precedence, the
+// defaults, the YAML file named by -config or MAILER_CONFIG, environment
+// variables and command-line flags.
+func loadConfig(args []string) (config, []setting, *flag.FlagSet, error) {
+	var cfg config
+
+	fs, settings := configFlags(&cfg)
+	path := fs.String("config", os.Getenv("MAILER_CONFIG"), "YAML configuration file")
+
+	if err := fs.Parse(args); err != nil {
+		return cfg, nil, nil, err
+	}
+
+	onCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { onCommandLine[f.Name] = true })
+
+	known := make(map[string]bool)
+	for _, s := range settings {
+		known[s.key] = true
+	}
+
+	if *path != "" {
+		values, err := readConfigFile(*path, &cfg)
+		if err != nil {
+			return cfg, nil, nil, err
+		}
+
+		for key, value := range values {
+			if !known[key] {
+				return cfg, nil, nil, fmt.Errorf("%s: unknown setting %q", *path, key)
+			}
+			if onCommandLine[key] {
+				continue
+			}
+			if err := fs.Set(key, value); err != nil {
+				return cfg, nil, nil, fmt.Errorf("%s: %s: %v", *path, key, err)
+			}
+		}
+	}
+
+	for _, s := range settings {
+		value, ok := os.LookupEnv(s.env)
+		if !ok || value == "" || onCommandLine[s.key] {
+			continue
+		}
+		if err := fs.Set(s.key, value); err != nil {
+			return cfg, nil, nil, fmt.Errorf("%s: %v", s.env, err)
+		}
+	}
+
+	if cfg.mail.from == "" {
+		cfg.mail.from = cfg.mail.user
+	}
+	if cfg.mail.domain == "" {
+		cfg.mail.domain = mailmsg.Domain(cfg.mail.from)
+	}
+
+	return cfg, settings, fs, nil
+}
+
+// readConfigFile flattens a YAML document into dotted keys. Lists become
+// comma-separated values. The relays, routing, webhooks and dkim.keys
+// sections have no flag or environment equivalent and are decoded straight
+// into cfg.
+func readConfigFile(path string, cfg *config) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var sections struct {
+		Relays   []relayConfig       `yaml:"relays"`
+		Routing  map[string][]string `yaml:"routing"`
+		Webhooks []webhookConfig     `yaml:"webhooks"`
+		DKIM     struct {
+			Keys []dkimKeyConfig `yaml:"keys"`
+		} `yaml:"dkim"`
+	}
+	if err := yaml.Unmarshal(b, &sections); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	cfg.relays = sections.Relays
+	cfg.routing = sections.Routing
+	cfg.webhooks = sections.Webhooks
+	cfg.dkim.keys = sections.DKIM.Keys
+
+	var doc map[string]any
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	delete(doc, "relays")
+	delete(doc, "routing")
+	delete(doc, "webhooks")
+	if d, ok := doc["dkim"].(map[string]any); ok {
+		delete(d, "keys")
+	}
+
+	values := make(map[string]string)
+
+	var flatten func(prefix string, v any)
+	flatten = func(prefix string, v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			for k, child := range v {
+				if prefix != "" {
+					k = prefix + "." + k
+				}
+				flatten(k, child)
+			}
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[prefix] = strings.Join(items, ",")
+		case nil:
+			values[prefix] = ""
+		default:
+			values[prefix] = fmt.Sprint(v)
+		}
+	}
+	flatten("", doc)
+
+	return values, nil
+}
+
+// validate reports every problem with cfg at once so that a bad deployment
+// fails at startup instead of on the first send.
+func (cfg config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(cfg.port > 0 && cfg.port < 65536, "server.port (PORT) must be between 1 and 65535")
+
+	switch cfg.mail.transport {
+	case "smtp":
+		if len(cfg.relays) == 0 {
+			check(cfg.mail.host != "", "smtp.host (EMAIL_HOST) is required by the smtp transport")
+			check(cfg.mail.port != "", "smtp.port (EMAIL_PORT) is required by the smtp transport")
+		}
+		check(cfg.breaker.failures > 0, "smtp.breaker_failures (SMTP_BREAKER_FAILURES) must be at least 1")
+		check(cfg.pool.size > 0, "smtp.pool_size (SMTP_POOL_SIZE) must be at least 1")
+		check(cfg.pool.maxMessages > 0, "smtp.max_messages (SMTP_MAX_MESSAGES) must be at least 1")
+		check(cfg.pool.idleTimeout > 0, "smtp.idle_timeout (SMTP_IDLE_TIMEOUT) must be positive")
+		check(cfg.pool.timeout > 0, "smtp.timeout (SMTP_TIMEOUT) must be positive")
+
+		for _, rc := range cfg.relayConfigs() {
+			_, err := smtpTLSConfig(rc)
+			check(err == nil, "relay %s: %v", rc.Name, err)
+
+			_, err = smtpAuth(rc)
+			check(err == nil, "relay %s: %v", rc.Name, err)
+			check(rc.Auth != smtpAuthXOAuth2 || rc.OAuthTokenURL != "" || rc.Password != "", "relay %s: xoauth2 needs an access token or a token URL", rc.Name)
+		}
+	case "mx":
+		check(cfg.mx.port != "", "mx.port (MX_PORT) is required by the mx transport")
+		check(cfg.mx.timeout > 0, "mx.timeout (MX_TIMEOUT) must be positive")
+		check(cfg.mx.tls == smtpTLSNone || cfg.mx.tls == smtpTLSOpportunistic || cfg.mx.tls == smtpTLSRequired, "mx.tls: unknown mode %q", cfg.mx.tls)
+		check(cfg.mx.helo != "" || cfg.mail.domain != "", "mx.helo (MX_HELO) or mail.domain is required by the mx transport")
+		_, err := parseStaticMX(cfg.mx.hosts)
+		check(err == nil, "mx.hosts: %v", err)
+	case "file":
+		check(cfg.mail.dir != "", "mail.dir (EMAIL_DIR) is required by the file transport")
+	case "memory":
+	default:
+		check(false, "mail.transport: unknown transport %q", cfg.mail.transport)
+	}
+
+	names := make(map[string]bool)
+	for i, r := range cfg.relays {
+		check(r.Name != "", "relays[%d]: name is required", i)
+		check(r.Host != "", "relays[%d]: host is required", i)
+		check(r.Port != "", "relays[%d]: port is required", i)
+		check(r.Weight >= 0, "relays[%d]: weight must not be negative", i)
+		check(!names[r.Name], "relays[%d]: duplicate relay name %q", i, r.Name)
+		names[r.Name] = true
+	}
+
+	for template, relays := range cfg.routing {
+		check(len(relays) > 0, "routing.%s: at least one relay is required", template)
+		for _, name := range relays {
+			check(names[name], "routing.%s: unknown relay %q", template, name)
+		}
+	}
+
+	_, err := newDKIMSigners(cfg)
+	check(err == nil, "dkim: %v", err)
+
+	_, err = mail.ParseAddress(cfg.mail.from)
+	check(err == nil, "mail.from (EMAIL_FROM) or smtp.user (EMAIL_USER) must be a valid address")
+
+	if cfg.mail.replyTo != "" {
+		_, err := mail.ParseAddress(cfg.mail.replyTo)
+		check(err == nil, "mail.reply_to (EMAIL_REPLY_TO) must be a valid address")
+	}
+
+	_, err = mail.ParseAddressList(cfg.mail.recipients)
+	check(err == nil, "contact.recipients (RECEPIENTS) must be a comma-separated list of addresses")
+
+	check(cfg.queue.dir != "", "queue.dir (QUEUE_DIR) is required")
+	check(cfg.queue.workers > 0, "queue.workers (QUEUE_WORKERS) must be at least 1")
+
+	check(cfg.retry.maxAttempts > 0, "retry.max_attempts (RETRY_MAX_ATTEMPTS) must be at least 1")
+	check(cfg.retry.baseDelay > 0, "retry.base_delay (RETRY_BASE_DELAY) must be positive")
+	check(cfg.retry.maxDelay >= cfg.retry.baseDelay, "retry.max_delay (RETRY_MAX_DELAY) must not be below retry.base_delay")
+
+	check(cfg.webhook.maxAttempts > 0, "webhook.max_attempts (WEBHOOK_MAX_ATTEMPTS) must be at least 1")
+	check(cfg.webhook.baseDelay > 0, "webhook.base_delay (WEBHOOK_BASE_DELAY) must be positive")
+	check(cfg.webhook.maxDelay >= cfg.webhook.baseDelay, "webhook.max_delay (WEBHOOK_MAX_DELAY) must not be below webhook.base_delay")
+	check(cfg.webhook.timeout > 0, "webhook.timeout (WEBHOOK_TIMEOUT) must be positive")
+
+	hooks := make(map[string]bool)
+	for i, wc := range cfg.webhooks {
+		check(wc.Name != "", "webhooks[%d]: name is required", i)
+		check(!hooks[wc.Name], "webhooks[%d]: duplicate webhook name %q", i, wc.Name)
+		hooks[wc.Name] = true
+
+		u, err := url.Parse(wc.URL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "webhooks[%d]: url must be an http or https URL", i)
+
+		for _, ev := range wc.Events {
+			check(slices.Contains(webhookEvents, ev), "webhooks[%d]: unknown event %q, want one of %s", i, ev, strings.Join(webhookEvents, ", "))
+		}
+	}
+
+	check(cfg.suppression.bounceExpiry >= 0, "suppression.bounce_expiry (SUPPRESSION_BOUNCE_EXPIRY) must not be negative")
+	check(cfg.bounce.softLimit > 0, "bounce.soft_limit (BOUNCE_SOFT_LIMIT) must be at least 1")
+	check(cfg.bounce.softWindow > 0, "bounce.soft_window (BOUNCE_SOFT_WINDOW) must be positive")
+	if cfg.bounce.maildir != "" || cfg.bounce.imapAddr != "" {
+		check(cfg.bounce.pollInterval > 0, "bounce.poll_interval (BOUNCE_POLL_INTERVAL) must be positive")
+	}
+	if cfg.bounce.maildir != "" {
+		info, err := os.Stat(filepath.Join(cfg.bounce.maildir, "new"))
+		check(err == nil && info.IsDir(), "bounce.maildir (BOUNCE_MAILDIR) must be a maildir with a new directory")
+	}
+	if cfg.bounce.imapAddr != "" {
+		_, _, err := net.SplitHostPort(cfg.bounce.imapAddr)
+		check(err == nil, "bounce.imap_addr (BOUNCE_IMAP_ADDR) must be host:port")
+		check(cfg.bounce.imapTLS == "implicit" || cfg.bounce.imapTLS == "none", "bounce.imap_tls: unknown mode %q", cfg.bounce.imapTLS)
+		check(cfg.bounce.imapUser != "", "bounce.imap_user (BOUNCE_IMAP_USER) is required with bounce.imap_addr")
+	}
+
+	for key, limit := range map[string]string{"limits.body": cfg.limits.body, "limits.attachments": cfg.limits.attachments} {
+		_, err := bytes.Parse(limit)
+		check(err == nil, "%s: invalid size %q", key, limit)
+	}
+
+	if cfg.auth.disabled {
+		check(cfg.env != "production", "auth.disabled (AUTH_DISABLED) is not allowed in production")
+	} else {
+		keys, err := loadAPIKeys(cfg.auth.keysFile)
+		check(err == nil, "auth.keys_file: %v", err)
+		check(err != nil || keys.enabled(), "auth.keys_file (API_KEYS_FILE) must name a file with at least one key unless auth.disabled is set")
+	}
+
+	check(cfg.signing.secret == "" || cfg.signing.window > 0, "signing.window (SIGNING_WINDOW) must be positive")
+
+	for key, list := range map[string]string{"ip.admin": cfg.ip.admin, "ip.internal": cfg.ip.internal, "ip.trusted_proxies": cfg.ip.trustedProxies} {
+		_, err := parseIPAllowlist(list)
+		check(err == nil, "%s: %v", key, err)
+	}
+
+	_, err = newSpamFilter(cfg)
+	check(err == nil, "spam: %v", err)
+	check(cfg.spam.captcha != "stub" || cfg.spam.captchaStubToken != "", "spam.captcha_stub_token is required by the stub captcha")
+
+	_, err = newRateLimitStore(cfg)
+	check(err == nil, "ratelimit.store: %v", err)
+
+	_, err = parseRateLimitPolicy(cfg.ratelimit.ip)
+	check(err == nil, "ratelimit.ip: %v", err)
+
+	_, err = parseRateLimitPolicies(cfg.ratelimit.recipients)
+	check(err == nil, "ratelimit.recipients: %v", err)
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+
+	return errors.Join(errs...)
+}
+
+// printConfig writes the effective configuration as YAML with secrets
+// redacted.
+func printConfig(w io.Writer, cfg config, fs *flag.FlagSet, settings []setting) {
+	section := ""
+
+	for _, s := range settings {
+		group, name, _ := strings.Cut(s.key, ".")
+		if group != section {
+			if section != "" {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "%s:\n", group)
+			section = group
+		}
+
+		value := fs.Lookup(s.key).Value.String()
+		if s.secret {
+			value = redact(value)
+		}
+
+		fmt.Fprintf(w, "  %s: %q  # %s\n", name, value, s.env)
+	}
+
+	if len(cfg.relays) > 0 {
+		fmt.Fprint(w, "\nrelays:\n")
+		for _, r := range cfg.relayConfigs() {
+			fmt.Fprintf(w, "  - name: %q\n    host: %q\n    port: %q\n    user: %q\n    password: %q\n    priority: %d\n    weight: %d\n",
+				r.Name, r.Host, r.Port, r.User, redact(r.Password), r.Priority, r.Weight)
+			fmt.Fprintf(w, "    tls: %q\n    tls_min_version: %q\n    ca_file: %q\n    cert_file: %q\n    key_file: %q\n    server_name: %q\n",
+				r.TLS, r.TLSMinVersion, r.CAFile, r.CertFile, r.KeyFile, r.ServerName)
+			fmt.Fprintf(w, "    auth: %q\n    oauth_token_url: %q\n    oauth_client_id: %q\n    oauth_client_secret: %q\n    oauth_refresh_token: %q\n",
+				r.Auth, r.OAuthTokenURL, r.OAuthClientID, redact(r.OAuthClientSecret), redact(r.OAuthRefreshToken))
+		}
+	}
+
+	if keys := cfg.dkimKeys(); len(keys) > 0 {
+		fmt.Fprint(w, "\ndkim keys:\n")
+		for _, k := range keys {
+			fmt.Fprintf(w, "  - domain: %q\n    selector: %q\n    key_file: %q\n", k.Domain, k.Selector, k.KeyFile)
+		}
+	}
+
+	if len(cfg.webhooks) > 0 {
+		fmt.Fprint(w, "\nwebhooks:\n")
+		for _, wc := range cfg.webhooks {
+			fmt.Fprintf(w, "  - name: %q\n    url: %q\n    secret: %q\n    events: [%s]\n", wc.Name, wc.URL, redact(wc.Secret), strings.Join(wc.Events, ", "))
+		}
+	}
+
+	if len(cfg.routing) > 0 {
+		templates := make([]string, 0, len(cfg.routing))
+		for t := range cfg.routing {
+			templates = append(templates, t)
+		}
+		sort.Strings(templates)
+
+		fmt.Fprint(w, "\nrouting:\n")
+		for _, t := range templates {
+			fmt.Fprintf(w, "  %q: [%s]\n", t, strings.Join(cfg.routing[t], ", "))
+		}
+	}
+}
+
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+// configCheck implements "mailer config check": it prints the effective
+// configuration and exits non-zero if it is invalid.
+func configCheck(args []string) int {
+	cfg, settings, fs, err := loadConfig(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	printConfig(os.Stdout, cfg, fs, settings)
+
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "\ninvalid configuration:\n%v\n", err)
+		return 1
+	}
+
+	fmt.Fprintln(os.Stderr, "\nconfiguration OK")
+	return 0
+}
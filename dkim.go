@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+
+	"mailer/internal/dkim"
+	"mailer/internal/mailmsg"
+)
+
+// dkimKeyConfig describes the signing key for one sender domain in the
+// config file.
+type dkimKeyConfig struct {
+	Domain   string `yaml:"domain"`
+	Selector string `yaml:"selector"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// dkimKeys returns the configured keys. Without a keys list, dkim.selector
+// and dkim.key_file describe a single key for mail.domain.
+func (cfg config) dkimKeys() []dkimKeyConfig {
+	if len(cfg.dkim.keys) > 0 {
+		return cfg.dkim.keys
+	}
+
+	if cfg.dkim.keyFile == "" {
+		return nil
+	}
+
+	return []dkimKeyConfig{{
+		Domain:   cfg.mail.domain,
+		Selector: cfg.dkim.selector,
+		KeyFile:  cfg.dkim.keyFile,
+	}}
+}
+
+// dkimSigners maps a lowercased sender domain to its signer.
+type dkimSigners map[string]*dkim.Signer
+
+func newDKIMSigners(cfg config) (dkimSigners, error) {
+	var headers []string
+	for _, h := range strings.Split(cfg.dkim.headers, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			headers = append(headers, h)
+		}
+	}
+
+	signers := make(dkimSigners)
+
+	for _, k := range cfg.dkimKeys() {
+		if k.Domain == "" || k.Selector == "" {
+			return nil, fmt.Errorf("key %s: domain and selector are required", k.KeyFile)
+		}
+
+		domain := strings.ToLower(k.Domain)
+		if _, ok := signers[domain]; ok {
+			return nil, fmt.Errorf("more than one key for %s", k.Domain)
+		}
+
+		b, err := os.ReadFile(k.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key for %s: %v", k.Domain, err)
+		}
+
+		key, err := dkim.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key for %s: %v", k.Domain, err)
+		}
+
+		signers[domain] = &dkim.Signer{
+			Domain:   k.Domain,
+			Selector: k.Selector,
+			Key:      key,
+			Headers:  headers,
+		}
+	}
+
+	return signers, nil
+}
+
+// sign signs msg with the key for the sender's domain. Mail from domains
+// without a key is returned unchanged.
+func (s dkimSigners) sign(from string, msg []byte) ([]byte, error) {
+	signer, ok := s[strings.ToLower(mailmsg.Domain(from))]
+	if !ok {
+		return msg, nil
+	}
+
+	return signer.Sign(msg)
+}
+
+// dkimCheck implements "mailer dkim check": for every configured key it
+// signs a probe message, verifies it against the key's own public half and,
+// with -dns, against the record published in DNS. It prints the TXT record
+// each selector needs.
+func dkimCheck(args []string) int {
+	dns := false
+	var rest []string
+	for _, a := range args {
+		if a == "-dns" || a == "--dns" {
+			dns = true
+			continue
+		}
+		rest = append(rest, a)
+	}
+
+	cfg, _, _, err := loadConfig(rest)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	signers, err := newDKIMSigners(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if len(signers) == 0 {
+		fmt.Fprintln(os.Stderr, "no DKIM keys configured")
+		return 1
+	}
+
+	failed := false
+
+	for domain, signer := range signers {
+		record, err := signer.Record()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", domain, err)
+			failed = true
+			continue
+		}
+
+		fmt.Printf("%s._domainkey.%s TXT %q\n", signer.Selector, signer.Domain, record)
+
+		probe := &mailmsg.Message{
+			From:    mail.Address{Address: "dkim-check@" + signer.Domain},
+			To:      []mail.Address{{Address: "dkim-check@" + signer.Domain}},
+			Subject: "DKIM check",
+			ID:      mailmsg.NewID(signer.Domain),
+			Text:    "DKIM check\n",
+		}
+
+		msg, err := probe.Bytes()
+		if err == nil {
+			msg, err = signer.Sign(msg)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: failed to sign: %v\n", domain, err)
+			failed = true
+			continue
+		}
+
+		local := func(string, string) (string, error) { return record, nil }
+		if err := dkim.Verify(msg, local); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: signature does not verify: %v\n", domain, err)
+			failed = true
+			continue
+		}
+
+		if dns {
+			if err := dkim.Verify(msg, dkim.LookupDNS); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: DNS check failed: %v\n", domain, err)
+				failed = true
+				continue
+			}
+		}
+	}
+
+	if failed {
+		return 1
+	}
+
+	fmt.Fprintln(os.Stderr, "DKIM OK")
+	return 0
+}
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
@@ -20,14 +28,40 @@ func (app *application) sendContactEmailHandler(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, envelope{"error": err.Error()})
 	}
 
+	reasons, err := app.spam.check(input, c.RealIP(), time.Now())
+	if err != nil {
+		log.Printf("Error checking contact form: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to queue emails"})
+	}
+
+	subject := ""
+	if len(reasons) > 0 {
+		log.Printf("Contact form from %s looks like spam (%s), action %s", c.RealIP(), strings.Join(reasons, "; "), app.spam.action)
+
+		switch app.spam.action {
+		case spamActionDrop:
+			return c.JSON(http.StatusAccepted, envelope{"message": "Emails queued successfully!", "id": newMessageID()})
+		case spamActionReject:
+			return c.JSON(http.StatusUnprocessableEntity, envelope{"error": "message rejected"})
+		case spamActionFlag:
+			if t, ok := app.templates.get("contactus"); ok {
+				subject = "[SPAM] " + t.schema.Subject
+			}
+		}
+	}
+
 	recipients := strings.Split(app.config.mail.recipients, ",")
 
-	if err := app.sendContactUsEmail(input, recipients); err != nil {
-		log.Printf("Error sending email: %v", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to send emails"})
+	id, err := app.sendContactUsEmail(input, recipients, subject)
+	if err != nil {
+		return app.publicQueueErrorResponse(c, err, "Failed to queue emails")
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{"message": "Emails sent successfully!"})
+	return c.JSON(http.StatusAccepted, envelope{"message": "Emails queued successfully!", "id": id})
+}
+
+func (app *application) contactTokenHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, envelope{"token": app.spam.issueToken(time.Now())})
 }
 
 func (app *application) sendWelcomeEmailHandler(c echo.Context) error {
@@ -42,12 +76,12 @@ func (app *application) sendWelcomeEmailHandler(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, envelope{"error": err.Error()})
 	}
 
-	if err := app.sendWelcomeEmail(input); err != nil {
-		log.Printf("Error sending email: %v", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to send email"})
+	id, err := app.sendWelcomeEmail(input)
+	if err != nil {
+		return app.queueErrorResponse(c, err, "Failed to queue email")
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{"message": "Email sent successfully!"})
+	return c.JSON(http.StatusAccepted, envelope{"message": "Email queued successfully!", "id": id})
 }
 
 func (app *application) sendActivateEmailHandler(c echo.Context) error {
@@ -62,12 +96,12 @@ func (app *application) sendActivateEmailHandler(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, envelope{"error": err.Error()})
 	}
 
-	if err := app.sendActivateEmail(input); err != nil {
-		log.Printf("Error sending email: %v", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to send email"})
+	id, err := app.sendActivateEmail(input)
+	if err != nil {
+		return app.queueErrorResponse(c, err, "Failed to queue email")
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{"message": "Email sent successfully!"})
+	return c.JSON(http.StatusAccepted, envelope{"message": "Email queued successfully!", "id": id})
 }
 
 func (app *application) sendPasswordResetEmailHandler(c echo.Context) error {
@@ -82,12 +116,12 @@ func (app *application) sendPasswordResetEmailHandler(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, envelope{"error": err.Error()})
 	}
 
-	if err := app.sendPasswordResetEmail(input); err != nil {
-		log.Printf("Error sending email: %v", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to send email"})
+	id, err := app.sendPasswordResetEmail(input)
+	if err != nil {
+		return app.queueErrorResponse(c, err, "Failed to queue email")
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{"message": "Email sent successfully!"})
+	return c.JSON(http.StatusAccepted, envelope{"message": "Email queued successfully!", "id": id})
 }
 
 
@@ -102,10 +136,341 @@ func (app *application) sendResetCompletedEmailHandler(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, envelope{"error": err.Error()})
 	}
 
-	if err := app.sendResetCompletedEmail(input); err != nil {
-		log.Printf("Error sending email: %v", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to send email"})
+	id, err := app.sendResetCompletedEmail(input)
+	if err != nil {
+		return app.queueErrorResponse(c, err, "Failed to queue email")
+	}
+
+	return c.JSON(http.StatusAccepted, envelope{"message": "Email queued successfully!", "id": id})
+}
+
+func (app *application) sendTemplateEmailHandler(c echo.Context) error {
+	var input SendRequest
+
+	if err := bindSendRequest(c, &input); err != nil {
+		return c.JSON(http.StatusBadRequest, envelope{"error": err.Error()})
+	}
+
+	if err := app.validator.Struct(&input); err != nil {
+		return c.JSON(http.StatusBadRequest, envelope{"error": err.Error()})
+	}
+
+	for i, a := range input.Attachments {
+		filename, err := attachmentName(a.Filename)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, envelope{"error": err.Error()})
+		}
+		input.Attachments[i].Filename = filename
+	}
+
+	name := c.Param("template")
+
+	t, ok := app.templates.get(name)
+	if !ok {
+		return c.JSON(http.StatusNotFound, envelope{"error": "template not found"})
+	}
+
+	if missing := t.missing(input.Data); len(missing) > 0 {
+		return c.JSON(http.StatusBadRequest, envelope{"error": "missing template variables: " + strings.Join(missing, ", ")})
+	}
+
+	if input.Subject == "" && t.schema.Subject == "" {
+		return c.JSON(http.StatusBadRequest, envelope{"error": "subject is required for this template"})
+	}
+
+	if input.From != "" && input.From != app.config.mail.from {
+		key, ok := c.Get("apiKey").(*apiKey)
+		if !ok || !key.allowsSender(input.From) {
+			return c.JSON(http.StatusForbidden, envelope{"error": "API key is not allowed to send from this address"})
+		}
+	}
+
+	id, err := app.sendTemplate(outboundEmail{
+		template:    name,
+		from:        input.From,
+		subject:     input.Subject,
+		to:          input.To,
+		data:        input.Data,
+		attachments: input.Attachments,
+	})
+	if err != nil {
+		return app.queueErrorResponse(c, err, "Failed to queue email")
+	}
+
+	return c.JSON(http.StatusAccepted, envelope{"message": "Email queued successfully!", "id": id})
+}
+
+// queueErrorResponse reports a failure to queue an email. Suppressed
+// recipients get 422 listing the entries, rate-limited recipients get 429
+// with Retry-After; anything else is logged as a 500.
+func (app *application) queueErrorResponse(c echo.Context, err error, msg string) error {
+	var supErr *suppressedError
+	if errors.As(err, &supErr) {
+		return c.JSON(http.StatusUnprocessableEntity, envelope{"error": supErr.Error(), "suppressed": supErr.recipients})
+	}
+
+	var rlErr *rateLimitError
+	if errors.As(err, &rlErr) {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rlErr.retryAfter.Seconds()))))
+		return c.JSON(http.StatusTooManyRequests, envelope{"error": rlErr.Error()})
+	}
+
+	log.Printf("Error queueing email: %v", err)
+	return c.JSON(http.StatusInternalServerError, envelope{"error": msg})
+}
+
+// publicQueueErrorResponse is queueErrorResponse for public routes, whose
+// callers must not learn our recipients: rate limits get a bare 429 and
+// everything else, suppressed recipients included, the generic error.
+func (app *application) publicQueueErrorResponse(c echo.Context, err error, msg string) error {
+	var rlErr *rateLimitError
+	if errors.As(err, &rlErr) {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rlErr.retryAfter.Seconds()))))
+		return c.JSON(http.StatusTooManyRequests, envelope{"error": "rate limit exceeded"})
+	}
+
+	log.Printf("Error queueing email: %v", err)
+	return c.JSON(http.StatusInternalServerError, envelope{"error": msg})
+}
+
+// bindSendRequest reads a SendRequest from JSON or from multipart/form-data,
+// where "to" may repeat, "data" holds a JSON object and files are uploaded as
+// "attachments" or "inline".
+func bindSendRequest(c echo.Context, input *SendRequest) error {
+	if !strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		return c.Bind(input)
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		return err
+	}
+
+	input.From = c.FormValue("from")
+	input.To = form.Value["to"]
+	input.Subject = c.FormValue("subject")
+
+	if data := c.FormValue("data"); data != "" {
+		if err := json.Unmarshal([]byte(data), &input.Data); err != nil {
+			return fmt.Errorf("invalid data field: %v", err)
+		}
+	}
+
+	for _, field := range []string{"attachments", "inline"} {
+		for _, fh := range form.File[field] {
+			f, err := fh.Open()
+			if err != nil {
+				return err
+			}
+
+			content, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+
+			input.Attachments = append(input.Attachments, AttachmentInput{
+				Filename: fh.Filename,
+				Content:  content,
+				Inline:   field == "inline",
+			})
+		}
+	}
+
+	return nil
+}
+
+func (app *application) listDeadLettersHandler(c echo.Context) error {
+	letters := app.deadLetters.list()
+
+	summaries := make([]envelope, 0, len(letters))
+	for _, l := range letters {
+		summaries = append(summaries, envelope{
+			"id":         l.Message.ID,
+			"to":         l.Message.To,
+			"attempts":   l.Message.Attempts,
+			"last_error": l.Message.LastError,
+			"failed_at":  l.FailedAt,
+		})
+	}
+
+	return c.JSON(http.StatusOK, envelope{"dead_letters": summaries})
+}
+
+func (app *application) showDeadLetterHandler(c echo.Context) error {
+	l, ok := app.deadLetters.get(c.Param("id"))
+	if !ok {
+		return c.JSON(http.StatusNotFound, envelope{"error": "dead letter not found"})
+	}
+
+	return c.JSON(http.StatusOK, envelope{
+		"id":         l.Message.ID,
+		"from":       l.Message.From,
+		"to":         l.Message.To,
+		"attempts":   l.Message.Attempts,
+		"last_error": l.Message.LastError,
+		"created_at": l.Message.CreatedAt,
+		"failed_at":  l.FailedAt,
+		"data":       string(l.Message.Data),
+	})
+}
+
+func (app *application) requeueDeadLetterHandler(c echo.Context) error {
+	l, ok := app.deadLetters.get(c.Param("id"))
+	if !ok {
+		return c.JSON(http.StatusNotFound, envelope{"error": "dead letter not found"})
+	}
+
+	if err := app.suppressed.check(l.Message.To); err != nil {
+		return app.queueErrorResponse(c, err, "Failed to requeue email")
+	}
+
+	msg := *l.Message
+	msg.Attempts = 0
+	msg.LastError = ""
+	msg.NextAttempt = time.Time{}
+
+	app.setStatus(&msg, statusQueued, "")
+
+	if err := app.queue.push(&msg); err != nil {
+		app.setStatus(&msg, statusFailed, err.Error())
+		log.Printf("Error requeueing email: %v", err)
+		return c.JSON(http.StatusInternalServerError, envelope{"error": "Failed to requeue email"})
+	}
+
+	if err := app.deadLetters.remove(msg.ID); err != nil {
+		log.Printf("Error removing dead letter: %v", err)
+	}
+
+	return c.JSON(http.StatusAccepted, envelope{"message": "Email requeued successfully!", "id": msg.ID})
+}
+
+func (app *application) showMessageStatusHandler(c echo.Context) error {
+	st, ok := app.statuses.get(c.Param("id"))
+	if !ok {
+		return c.JSON(http.StatusNotFound, envelope{"error": "message not found"})
+	}
+
+	return c.JSON(http.StatusOK, envelope{"message": st})
+}
+
+// inboundBounceHandler accepts a raw bounce message, as piped in by the MTA
+// receiving mail for the bounce address.
+func (app *application) inboundBounceHandler(c echo.Context) error {
+	raw, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, envelope{"error": err.Error()})
+	}
+
+	report, err := app.processBounce(raw)
+	if errors.Is(err, errNotBounce) || errors.Is(err, errUnmatchedBounce) {
+		return c.JSON(http.StatusUnprocessableEntity, envelope{"error": err.Error()})
+	}
+	if err != nil {
+		log.Printf("Error processing bounce: %v", err)
+		return c.JSON(http.StatusInternalServerError, envelope{"error": "Failed to process bounce"})
+	}
+
+	return c.JSON(http.StatusOK, envelope{"bounce": report})
+}
+
+func (app *application) showAddressHandler(c echo.Context) error {
+	st, ok := app.addresses.get(c.Param("address"))
+	if !ok {
+		return c.JSON(http.StatusNotFound, envelope{"error": "no bounces recorded for address"})
+	}
+
+	return c.JSON(http.StatusOK, envelope{"address": st})
+}
+
+func (app *application) resetAddressHandler(c echo.Context) error {
+	ok, err := app.addresses.reset(c.Param("address"))
+	if err != nil {
+		log.Printf("Error resetting address: %v", err)
+		return c.JSON(http.StatusInternalServerError, envelope{"error": "Failed to reset address"})
+	}
+	if !ok {
+		return c.JSON(http.StatusNotFound, envelope{"error": "no bounces recorded for address"})
+	}
+
+	return c.JSON(http.StatusOK, envelope{"message": "Address reset"})
+}
+
+// listSuppressionsHandler exports the suppression list as JSON or, with
+// ?format=csv, as CSV.
+func (app *application) listSuppressionsHandler(c echo.Context) error {
+	entries := app.suppressed.list()
+
+	if c.QueryParam("format") != "csv" {
+		return c.JSON(http.StatusOK, envelope{"suppressions": entries})
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="suppressions.csv"`)
+	c.Response().WriteHeader(http.StatusOK)
+
+	w := csv.NewWriter(c.Response())
+	w.Write([]string{"value", "type", "reason", "created_at", "expires_at"})
+	for _, s := range entries {
+		expires := ""
+		if s.ExpiresAt != nil {
+			expires = s.ExpiresAt.Format(time.RFC3339)
+		}
+		w.Write([]string{s.Value, s.Type, s.Reason, s.CreatedAt.Format(time.RFC3339), expires})
+	}
+	w.Flush()
+
+	return w.Error()
+}
+
+func (app *application) addSuppressionHandler(c echo.Context) error {
+	var input SuppressionInput
+
+	if err := c.Bind(&input); err != nil {
+		return c.JSON(http.StatusBadRequest, envelope{"error": err.Error()})
+	}
+
+	if err := app.validator.Struct(input); err != nil {
+		return c.JSON(http.StatusBadRequest, envelope{"error": err.Error()})
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{"message": "Email sent successfully!"})
+	if input.ExpiresAt != nil && !input.ExpiresAt.After(time.Now()) {
+		return c.JSON(http.StatusBadRequest, envelope{"error": "expires_at must be in the future"})
+	}
+
+	reason := input.Reason
+	if reason == "" {
+		reason = "manual"
+	}
+
+	s := newSuppression(input.Value, reason, input.ExpiresAt)
+	if s.Value == "" || strings.HasPrefix(s.Value, "@") || strings.HasSuffix(s.Value, "@") || strings.Count(s.Value, "@") > 1 {
+		return c.JSON(http.StatusBadRequest, envelope{"error": "value must be an address or a domain"})
+	}
+
+	if err := app.suppressed.add(s); err != nil {
+		log.Printf("Error adding suppression: %v", err)
+		return c.JSON(http.StatusInternalServerError, envelope{"error": "Failed to add suppression"})
+	}
+
+	return c.JSON(http.StatusCreated, envelope{"suppression": s})
+}
+
+func (app *application) removeSuppressionHandler(c echo.Context) error {
+	ok, err := app.suppressed.remove(c.Param("value"))
+	if err != nil {
+		log.Printf("Error removing suppression: %v", err)
+		return c.JSON(http.StatusInternalServerError, envelope{"error": "Failed to remove suppression"})
+	}
+	if !ok {
+		return c.JSON(http.StatusNotFound, envelope{"error": "suppression not found"})
+	}
+
+	return c.JSON(http.StatusOK, envelope{"message": "Suppression removed"})
+}
+
+// listWebhookDeliveriesHandler returns the webhook delivery log, newest
+// first. ?state=pending|delivered|failed narrows it down.
+func (app *application) listWebhookDeliveriesHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, envelope{"deliveries": app.webhooks.list(c.QueryParam("state"))})
 }
@@ -1,11 +1,17 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
-	"html/template"
-	"net/smtp"
+	"net/mail"
+	"path"
+	"regexp"
+	"strings"
 	"time"
+	"unicode"
+
+	"github.com/gabriel-vasile/mimetype"
+
+	"mailer/internal/mailmsg"
 )
 
 type ContactForm struct {
@@ -15,6 +21,12 @@ type ContactForm struct {
 	Phone     string `json:"phone" validate:"required"`
 	Service   string `json:"service" validate:"required"`
 	Message   string `json:"message" validate:"required"`
+
+	// Anti-abuse fields, checked by the spam filter rather than the
+	// validator. Website is a honeypot that people never see.
+	Website      string `json:"website"`
+	FormToken    string `json:"form_token"`
+	CaptchaToken string `json:"captcha_token"`
 }
 
 type SignupData struct {
@@ -32,8 +44,33 @@ type ResetCompleteData struct {
 	Email string `json:"email" validate:"required,email"`
 }
 
+type SendRequest struct {
+	From        string            `json:"from" validate:"omitempty,email"`
+	To          []string          `json:"to" validate:"required,min=1,dive,email"`
+	Subject     string            `json:"subject"`
+	Data        map[string]any    `json:"data"`
+	Attachments []AttachmentInput `json:"attachments" validate:"dive"`
+}
+
+// AttachmentInput is a file sent with a SendRequest, base64 encoded in JSON
+// requests. Inline attachments are referenced from the template as
+// cid:<filename>, with characters other than letters, digits, ".", "-" and
+// "_" replaced by "_".
+type AttachmentInput struct {
+	Filename string `json:"filename" validate:"required"`
+	Content  []byte `json:"content" validate:"required"`
+	Inline   bool   `json:"inline"`
+}
+
+// SuppressionInput adds an address, or a whole domain when value has no @,
+// to the suppression list.
+type SuppressionInput struct {
+	Value     string     `json:"value" validate:"required"`
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
 
-func (app *application) sendContactUsEmail(form ContactForm, recipients []string) error {
+func (app *application) sendContactUsEmail(form ContactForm, recipients []string, subject string) (string, error) {
 
 	type templateData struct {
 		ContactForm
@@ -45,136 +82,169 @@ func (app *application) sendContactUsEmail(form ContactForm, recipients []string
 		FormattedDate: time.Now().Format("January 2, 2006 at 3:04 PM"),
 	}
 
-	tmpl, err := template.New("email").Parse(contactusTemplate)
-	if err != nil {
-		return fmt.Errorf("failed to parse email template: %v", err)
-	}
+	return app.sendTemplate(outboundEmail{template: "contactus", subject: subject, to: recipients, replyTo: form.Email, data: data})
+}
 
-	var emailBody bytes.Buffer
-	if err := tmpl.Execute(&emailBody, data); err != nil {
-		return fmt.Errorf("failed to execute email template: %v", err)
-	}
+func (app *application) sendWelcomeEmail(data SignupData) (string, error) {
+	return app.sendTemplate(outboundEmail{template: "welcome", to: []string{data.Email}, data: data})
+}
 
-	toHeader := ""
-	for i, recipient := range recipients {
-		if i > 0 {
-			toHeader += ", "
-		}
-		toHeader += recipient
-	}
+func (app *application) sendActivateEmail(data ActivateOrResetData) (string, error) {
+	return app.sendTemplate(outboundEmail{template: "activate", to: []string{data.Email}, data: data})
+}
 
-	subject := "Contact Form Submission"
-	msg := fmt.Sprintf("Subject: %s\nTo: %s\nContent-Type: text/html\n\n%s", subject, toHeader, emailBody.String())
+func (app *application) sendPasswordResetEmail(data ActivateOrResetData) (string, error) {
+	return app.sendTemplate(outboundEmail{template: "pwdreset", to: []string{data.Email}, data: data})
+}
 
-	auth := smtp.PlainAuth("", app.config.mail.user, app.config.mail.pwd, app.config.mail.host)
-	err = smtp.SendMail(app.config.mail.host+":"+app.config.mail.port, auth, app.config.mail.user, recipients, []byte(msg))
-	if err != nil {
-		return fmt.Errorf("failed to send email: %v", err)
-	}
+func (app *application) sendResetCompletedEmail(data ResetCompleteData) (string, error) {
+	return app.sendTemplate(outboundEmail{template: "completedreset", to: []string{data.Email}, data: data})
+}
 
-	return nil
+// outboundEmail describes a templated email before it is rendered.
+type outboundEmail struct {
+	template    string
+	from        string
+	subject     string
+	to          []string
+	replyTo     string
+	data        any
+	attachments []AttachmentInput
 }
 
-func (app *application) sendWelcomeEmail(data SignupData) error {
+// sendTemplate renders the named template and queues it for recipients. An
+// empty subject falls back to the one in the template schema.
+func (app *application) sendTemplate(out outboundEmail) (string, error) {
 
-	tmpl, err := template.New("email").Parse(welcome_template)
-	if err != nil {
-		return fmt.Errorf("failed to parse email template: %v", err)
+	t, ok := app.templates.get(out.template)
+	if !ok {
+		return "", fmt.Errorf("template %q not found", out.template)
 	}
 
-	var emailBody bytes.Buffer
-	if err := tmpl.Execute(&emailBody, data); err != nil {
-		return fmt.Errorf("failed to execute email template: %v", err)
+	if err := app.suppressed.check(out.to); err != nil {
+		return "", err
 	}
 
-	recipients := []string{data.Email}
+	if err := app.recipientLimits.allow(out.template, out.to); err != nil {
+		return "", err
+	}
 
-	subject := "Welcome to Rent Management System - Account Activation Required"
-	msg := fmt.Sprintf("Subject: %s\nTo: %s\nContent-Type: text/html\n\n%s", subject, data.Email, emailBody.String())
+	subject := out.subject
+	if subject == "" {
+		subject = t.schema.Subject
+	}
 
-	auth := smtp.PlainAuth("", app.config.mail.user, app.config.mail.pwd, app.config.mail.host)
-	err = smtp.SendMail(app.config.mail.host+":"+app.config.mail.port, auth, app.config.mail.user, recipients, []byte(msg))
+	htmlBody, textBody, err := app.templates.render(out.template, out.data)
 	if err != nil {
-		return fmt.Errorf("failed to send email: %v", err)
+		return "", err
 	}
 
-	return nil
-}
+	id := newMessageID()
 
-func (app *application) sendActivateEmail(data ActivateOrResetData) error {
-
-	tmpl, err := template.New("email").Parse(activate_template)
-	if err != nil {
-		return fmt.Errorf("failed to parse email template: %v", err)
+	from := mail.Address{Name: app.config.mail.fromName, Address: app.config.mail.from}
+	if out.from != "" && out.from != app.config.mail.from {
+		from = mail.Address{Address: out.from}
 	}
 
-	var emailBody bytes.Buffer
-	if err := tmpl.Execute(&emailBody, data); err != nil {
-		return fmt.Errorf("failed to execute email template: %v", err)
+	m := &mailmsg.Message{
+		From:    from,
+		Subject: subject,
+		ID:      id + "@" + app.config.mail.domain,
+		Text:    textBody,
+		HTML:    htmlBody,
 	}
 
-	recipients := []string{data.Email}
+	for _, addr := range out.to {
+		m.To = append(m.To, mail.Address{Address: addr})
+	}
 
-	subject := "Rent Management System - Account Activation Required"
-	msg := fmt.Sprintf("Subject: %s\nTo: %s\nContent-Type: text/html\n\n%s", subject, data.Email, emailBody.String())
+	replyTo := out.replyTo
+	if replyTo == "" {
+		replyTo = app.config.mail.replyTo
+	}
+	if replyTo != "" {
+		m.ReplyTo = []mail.Address{{Address: replyTo}}
+	}
 
-	auth := smtp.PlainAuth("", app.config.mail.user, app.config.mail.pwd, app.config.mail.host)
-	err = smtp.SendMail(app.config.mail.host+":"+app.config.mail.port, auth, app.config.mail.user, recipients, []byte(msg))
-	if err != nil {
-		return fmt.Errorf("failed to send email: %v", err)
+	for _, a := range out.attachments {
+		att := mailmsg.Attachment{
+			Filename:    a.Filename,
+			ContentType: mimetype.Detect(a.Content).String(),
+			Data:        a.Content,
+		}
+		if a.Inline {
+			att.ContentID = contentID(a.Filename)
+		}
+		m.Attachments = append(m.Attachments, att)
 	}
 
-	return nil
-}
+	for _, match := range cidRefs.FindAllStringSubmatch(htmlBody, -1) {
+		name := match[1]
+		if hasContentID(m.Attachments, name) {
+			continue
+		}
 
-func (app *application) sendPasswordResetEmail(data ActivateOrResetData) error {
+		if b, ok := app.templates.asset(name); ok {
+			m.Attachments = append(m.Attachments, mailmsg.Attachment{
+				Filename:    name,
+				ContentType: mimetype.Detect(b).String(),
+				ContentID:   name,
+				Data:        b,
+			})
+		}
+	}
 
-	tmpl, err := template.New("email").Parse(pwdreset_template)
+	data, err := m.Bytes()
 	if err != nil {
-		return fmt.Errorf("failed to parse email template: %v", err)
+		return "", fmt.Errorf("failed to build email: %v", err)
 	}
 
-	var emailBody bytes.Buffer
-	if err := tmpl.Execute(&emailBody, data); err != nil {
-		return fmt.Errorf("failed to execute email template: %v", err)
+	data, err = app.dkim.sign(from.Address, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign email: %v", err)
 	}
 
-	recipients := []string{data.Email}
-
-	subject := "Password Reset Request for Rent Management System"
-	msg := fmt.Sprintf("Subject: %s\nTo: %s\nContent-Type: text/html\n\n%s", subject, data.Email, emailBody.String())
-
-	auth := smtp.PlainAuth("", app.config.mail.user, app.config.mail.pwd, app.config.mail.host)
-	err = smtp.SendMail(app.config.mail.host+":"+app.config.mail.port, auth, app.config.mail.user, recipients, []byte(msg))
-	if err != nil {
-		return fmt.Errorf("failed to send email: %v", err)
+	if err := app.enqueue(id, out.template, from.Address, out.to, data); err != nil {
+		return "", fmt.Errorf("failed to queue email: %v", err)
 	}
 
-	return nil
+	return id, nil
 }
 
-func (app *application) sendResetCompletedEmail(data ResetCompleteData) error {
+var cidRefs = regexp.MustCompile(`cid:([^"'\s)>]+)`)
 
-	tmpl, err := template.New("email").Parse(completedreset_template)
-	if err != nil {
-		return fmt.Errorf("failed to parse email template: %v", err)
+// attachmentName checks a client supplied file name and strips any
+// directories from it, whichever separator the client used.
+func attachmentName(name string) (string, error) {
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return "", fmt.Errorf("attachment file name %q contains control characters", name)
 	}
 
-	var emailBody bytes.Buffer
-	if err := tmpl.Execute(&emailBody, data); err != nil {
-		return fmt.Errorf("failed to execute email template: %v", err)
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == "/" || name == ".." {
+		return "", fmt.Errorf("attachment file name is empty")
 	}
 
-	recipients := []string{data.Email}
+	return name, nil
+}
 
-	subject := "Password Changed for Rent Management System"
-	msg := fmt.Sprintf("Subject: %s\nTo: %s\nContent-Type: text/html\n\n%s", subject, data.Email, emailBody.String())
+// contentID derives the Content-ID of an inline attachment from its file
+// name, keeping only characters that are safe in the header.
+func contentID(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+}
 
-	auth := smtp.PlainAuth("", app.config.mail.user, app.config.mail.pwd, app.config.mail.host)
-	err = smtp.SendMail(app.config.mail.host+":"+app.config.mail.port, auth, app.config.mail.user, recipients, []byte(msg))
-	if err != nil {
-		return fmt.Errorf("failed to send email: %v", err)
+func hasContentID(attachments []mailmsg.Attachment, id string) bool {
+	for _, a := range attachments {
+		if a.ContentID == id {
+			return true
+		}
 	}
-
-	return nil
+	return false
 }
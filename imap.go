@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imapResponse is one untagged server response. Literals are cut out of the
+// line and kept, in order, in literals.
+type imapResponse struct {
+	line     string
+	literals [][]byte
+}
+
+// imapClient speaks the handful of IMAP4rev1 commands the bounce poller
+// needs over a single connection.
+type imapClient struct {
+	conn    net.Conn
+	rd      *bufio.Reader
+	tag     int
+	timeout time.Duration
+}
+
+func dialIMAP(addr, tlsMode string) (*imapClient, error) {
+	dialer := &net.Dialer{Timeout: smtpDialTimeout}
+
+	var conn net.Conn
+	var err error
+	if tlsMode == "implicit" {
+		host, _, _ := net.SplitHostPort(addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &imapClient{conn: conn, rd: bufio.NewReader(conn), timeout: time.Minute}
+
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	greeting, err := c.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting, "* OK") && !strings.HasPrefix(greeting, "* PREAUTH") {
+		conn.Close()
+		return nil, fmt.Errorf("imap: unexpected greeting %q", greeting)
+	}
+
+	return c, nil
+}
+
+func (c *imapClient) close() error {
+	return c.conn.Close()
+}
+
+// quote renders s as an IMAP quoted string.
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// cmd sends one command and returns the untagged responses that preceded
+// the tagged completion, or an error unless the command completed with OK.
+func (c *imapClient) cmd(format string, args ...any) ([]imapResponse, error) {
+	c.tag++
+	tag := "m" + strconv.Itoa(c.tag)
+
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, fmt.Sprintf(format, args...)); err != nil {
+		return nil, err
+	}
+
+	var responses []imapResponse
+	for {
+		r, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(r.line, tag+" ") {
+			status := strings.TrimPrefix(r.line, tag+" ")
+			if !strings.HasPrefix(status, "OK") {
+				return nil, fmt.Errorf("imap: %s", status)
+			}
+			return responses, nil
+		}
+
+		if strings.HasPrefix(r.line, "* ") {
+			responses = append(responses, r)
+		}
+	}
+}
+
+func (c *imapClient) readLine() (string, error) {
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readResponse reads a response line, following any {n} literals it
+// announces.
+func (c *imapClient) readResponse() (imapResponse, error) {
+	var r imapResponse
+
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return r, err
+		}
+
+		open := strings.LastIndexByte(line, '{')
+		if open < 0 || !strings.HasSuffix(line, "}") {
+			r.line += line
+			return r, nil
+		}
+
+		n, err := strconv.Atoi(line[open+1 : len(line)-1])
+		if err != nil {
+			r.line += line
+			return r, nil
+		}
+
+		lit := make([]byte, n)
+		if _, err := io.ReadFull(c.rd, lit); err != nil {
+			return r, err
+		}
+
+		r.line += line[:open]
+		r.literals = append(r.literals, lit)
+	}
+}
+
+func (c *imapClient) login(user, password string) error {
+	_, err := c.cmd("LOGIN %s %s", imapQuote(user), imapQuote(password))
+	return err
+}
+
+func (c *imapClient) selectMailbox(name string) error {
+	_, err := c.cmd("SELECT %s", imapQuote(name))
+	return err
+}
+
+// unseen returns the UIDs of messages without the \Seen flag.
+func (c *imapClient) unseen() ([]string, error) {
+	responses, err := c.cmd("UID SEARCH UNSEEN")
+	if err != nil {
+		return nil, err
+	}
+
+	var uids []string
+	for _, r := range responses {
+		if rest, ok := strings.CutPrefix(r.line, "* SEARCH"); ok {
+			uids = append(uids, strings.Fields(rest)...)
+		}
+	}
+
+	return uids, nil
+}
+
+// fetch returns the full message without setting \Seen.
+func (c *imapClient) fetch(uid string) ([]byte, error) {
+	responses, err := c.cmd("UID FETCH %s BODY.PEEK[]", uid)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range responses {
+		if strings.Contains(r.line, "FETCH") && len(r.literals) > 0 {
+			return r.literals[0], nil
+		}
+	}
+
+	return nil, fmt.Errorf("imap: no body returned for UID %s", uid)
+}
+
+func (c *imapClient) markSeen(uid string) error {
+	_, err := c.cmd(`UID STORE %s +FLAGS.SILENT (\Seen)`, uid)
+	return err
+}
+
+func (c *imapClient) logout() {
+	c.cmd("LOGOUT")
+	c.close()
+}
@@ -0,0 +1,397 @@
+// Package dkim signs and verifies messages with DomainKeys Identified Mail
+// (RFC 6376, RFC 8463) using relaxed/relaxed canonicalization.
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultHeaders are signed when a Signer has no header list of its own.
+var DefaultHeaders = []string{
+	"From", "Reply-To", "To", "Cc", "Subject", "Date", "Message-ID",
+	"MIME-Version", "Content-Type",
+}
+
+// Signer adds a DKIM-Signature header for one domain and selector. Key must
+// be an *rsa.PrivateKey or an ed25519.PrivateKey.
+type Signer struct {
+	Domain   string
+	Selector string
+	Key      crypto.Signer
+
+	// Headers lists the header fields to sign. Fields missing from a message
+	// are skipped. From is always required.
+	Headers []string
+}
+
+// ParsePrivateKey reads a PEM encoded PKCS#1 RSA key or a PKCS#8 RSA or
+// Ed25519 key.
+func ParsePrivateKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case ed25519.PrivateKey:
+			return key, nil
+		default:
+			return nil, fmt.Errorf("unsupported key type %T", key)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+func algorithm(pub crypto.PublicKey) (string, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return "rsa-sha256", nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", nil
+	default:
+		return "", fmt.Errorf("unsupported key type %T", pub)
+	}
+}
+
+// Record returns the TXT record to publish at <selector>._domainkey.<domain>.
+func (s *Signer) Record() (string, error) {
+	switch pub := s.Key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub), nil
+	default:
+		return "", fmt.Errorf("unsupported key type %T", pub)
+	}
+}
+
+// Sign returns msg with a DKIM-Signature header prepended. The message must
+// use CRLF line endings.
+func (s *Signer) Sign(msg []byte) ([]byte, error) {
+	algo, err := algorithm(s.Key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	headers, body := split(msg)
+
+	names := s.Headers
+	if len(names) == 0 {
+		names = DefaultHeaders
+	}
+
+	var signedNames []string
+	var signed []string
+	used := make(map[string]int)
+	for _, name := range names {
+		if h, ok := pick(headers, name, used); ok {
+			signedNames = append(signedNames, name)
+			signed = append(signed, relaxedHeader(h))
+		}
+	}
+
+	if used["from"] == 0 {
+		return nil, errors.New("message has no From header")
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+
+	tags := []string{
+		"v=1",
+		"a=" + algo,
+		"c=relaxed/relaxed",
+		"d=" + s.Domain,
+		"s=" + s.Selector,
+		"t=" + strconv.FormatInt(time.Now().Unix(), 10),
+		"h=" + strings.Join(signedNames, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]),
+	}
+	header := "DKIM-Signature: " + strings.Join(tags, ";\r\n ") + ";\r\n b="
+
+	digest := headerHash(signed, header)
+
+	opts := crypto.Hash(0)
+	if algo == "rsa-sha256" {
+		opts = crypto.SHA256
+	}
+
+	sig, err := s.Key.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.WriteString(header)
+	out.WriteString(fold(base64.StdEncoding.EncodeToString(sig)))
+	out.WriteString("\r\n")
+	out.Write(msg)
+
+	return out.Bytes(), nil
+}
+
+// KeyLookup returns the DKIM TXT record published for a domain and selector.
+type KeyLookup func(domain, selector string) (string, error)
+
+// LookupDNS finds the key record in DNS.
+func LookupDNS(domain, selector string) (string, error) {
+	records, err := net.LookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return "", err
+	}
+
+	for _, r := range records {
+		if strings.Contains(r, "p=") {
+			return r, nil
+		}
+	}
+
+	return "", fmt.Errorf("no DKIM key at %s._domainkey.%s", selector, domain)
+}
+
+var signatureValue = regexp.MustCompile(`(^|[;:])(\s*b\s*=)[^;]*`)
+
+// Verify checks the first DKIM-Signature header of msg against the key
+// returned by lookup. Only relaxed/relaxed signatures are supported.
+func Verify(msg []byte, lookup KeyLookup) error {
+	headers, body := split(msg)
+
+	var sigHeader string
+	for _, h := range headers {
+		if headerName(h) == "dkim-signature" {
+			sigHeader = h
+			break
+		}
+	}
+	if sigHeader == "" {
+		return errors.New("message is not signed")
+	}
+
+	_, value, _ := strings.Cut(sigHeader, ":")
+	tags := parseTags(value)
+
+	if tags["v"] != "1" {
+		return fmt.Errorf("unsupported signature version %q", tags["v"])
+	}
+	if tags["c"] != "relaxed/relaxed" {
+		return fmt.Errorf("unsupported canonicalization %q", tags["c"])
+	}
+	if _, ok := tags["l"]; ok {
+		return errors.New("body length limits are not supported")
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return errors.New("body hash does not match")
+	}
+
+	var signed []string
+	used := make(map[string]int)
+	for _, name := range strings.Split(tags["h"], ":") {
+		if h, ok := pick(headers, name, used); ok {
+			signed = append(signed, relaxedHeader(h))
+		}
+	}
+
+	if used["from"] == 0 {
+		return errors.New("signature does not cover the From header")
+	}
+
+	digest := headerHash(signed, signatureValue.ReplaceAllString(sigHeader, "$1$2"))
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %v", err)
+	}
+
+	record, err := lookup(tags["d"], tags["s"])
+	if err != nil {
+		return fmt.Errorf("key lookup failed: %v", err)
+	}
+
+	pub, err := parseRecord(record)
+	if err != nil {
+		return err
+	}
+
+	algo, err := algorithm(pub)
+	if err != nil {
+		return err
+	}
+	if algo != tags["a"] {
+		return fmt.Errorf("signature algorithm %q does not match the %s key", tags["a"], algo)
+	}
+
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, digest, sig) {
+			err = errors.New("ed25519: verification error")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("signature does not verify: %v", err)
+	}
+
+	return nil
+}
+
+func parseRecord(record string) (crypto.PublicKey, error) {
+	tags := parseTags(record)
+
+	der, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil || len(der) == 0 {
+		return nil, errors.New("key record has no valid public key")
+	}
+
+	switch tags["k"] {
+	case "", "rsa":
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return x509.ParsePKCS1PublicKey(der)
+		}
+		return pub, nil
+	case "ed25519":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 public key")
+		}
+		return ed25519.PublicKey(der), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", tags["k"])
+	}
+}
+
+// parseTags reads a tag=value list, dropping whitespace inside values.
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, field := range strings.Split(s, ";") {
+		k, v, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.TrimSpace(k)] = strings.Join(strings.Fields(v), "")
+	}
+	return tags
+}
+
+func headerHash(signed []string, sigHeader string) []byte {
+	h := sha256.New()
+	for _, s := range signed {
+		h.Write([]byte(s + "\r\n"))
+	}
+	h.Write([]byte(relaxedHeader(sigHeader)))
+	return h.Sum(nil)
+}
+
+// split separates the header fields, each with its folding kept, from the
+// body.
+func split(msg []byte) ([]string, []byte) {
+	head, body, found := bytes.Cut(msg, []byte("\r\n\r\n"))
+	if !found {
+		head = bytes.TrimSuffix(msg, []byte("\r\n"))
+	}
+
+	var headers []string
+	for _, line := range strings.Split(string(head), "\r\n") {
+		if len(headers) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			headers[len(headers)-1] += "\r\n" + line
+			continue
+		}
+		headers = append(headers, line)
+	}
+
+	return headers, body
+}
+
+func headerName(h string) string {
+	name, _, _ := strings.Cut(h, ":")
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// pick returns the last instance of a header not yet used, so that repeated
+// names in h= select instances from the bottom up.
+func pick(headers []string, name string, used map[string]int) (string, bool) {
+	key := strings.ToLower(strings.TrimSpace(name))
+
+	seen := 0
+	for i := len(headers) - 1; i >= 0; i-- {
+		if headerName(headers[i]) != key {
+			continue
+		}
+		if seen == used[key] {
+			used[key]++
+			return headers[i], true
+		}
+		seen++
+	}
+
+	return "", false
+}
+
+var wsp = regexp.MustCompile(`[ \t]+`)
+
+func relaxedHeader(h string) string {
+	name, value, _ := strings.Cut(h, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = wsp.ReplaceAllString(value, " ")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(value)
+}
+
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(wsp.ReplaceAllString(line, " "), " ")
+	}
+
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) == 0 {
+		return nil
+	}
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func fold(s string) string {
+	var b strings.Builder
+	for len(s) > 72 {
+		b.WriteString(s[:72])
+		b.WriteString("\r\n ")
+		s = s[72:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
@@ -0,0 +1,297 @@
+// Package mailmsg builds RFC 5322 email messages with MIME bodies.
+package mailmsg
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Message is an outgoing email. At least one of Text and HTML must be set;
+// when both are present the body is multipart/alternative.
+type Message struct {
+	From    mail.Address
+	ReplyTo []mail.Address
+	To      []mail.Address
+	Subject string
+	Date    time.Time
+
+	// ID is the Message-ID without angle brackets. NewID generates one.
+	ID string
+
+	Text string
+	HTML string
+
+	Attachments []Attachment
+}
+
+// Attachment is a file sent with the message. An attachment with a
+// ContentID is placed inline, next to the HTML body, so the HTML can refer to
+// it as cid:<ContentID>.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	ContentID   string
+	Data        []byte
+}
+
+// NewID returns a unique Message-ID value for domain.
+func NewID(domain string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%s@%s", hex.EncodeToString(b), domain)
+}
+
+// Domain returns the domain part of an address, or an empty string.
+func Domain(addr string) string {
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		return addr[i+1:]
+	}
+	return ""
+}
+
+// Bytes renders the message with CRLF line endings.
+func (m *Message) Bytes() ([]byte, error) {
+	if m.From.Address == "" {
+		return nil, errors.New("message has no From address")
+	}
+	if len(m.To) == 0 {
+		return nil, errors.New("message has no recipients")
+	}
+	if m.Text == "" && m.HTML == "" {
+		return nil, errors.New("message has no body")
+	}
+
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	id := m.ID
+	if id == "" {
+		id = NewID(Domain(m.From.Address))
+	}
+
+	var buf bytes.Buffer
+
+	writeHeader(&buf, "Date", date.Format(time.RFC1123Z))
+	writeHeader(&buf, "From", m.From.String())
+	if len(m.ReplyTo) > 0 {
+		writeHeader(&buf, "Reply-To", addressList(m.ReplyTo))
+	}
+	writeHeader(&buf, "To", addressList(m.To))
+	writeHeader(&buf, "Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	writeHeader(&buf, "Message-ID", "<"+id+">")
+	writeHeader(&buf, "MIME-Version", "1.0")
+
+	if err := m.writeBody(&buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// part is a MIME entity: its own header fields and its encoded body.
+type part struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+func (m *Message) writeBody(buf *bytes.Buffer) error {
+	body, err := m.alternative()
+	if err != nil {
+		return err
+	}
+
+	var inline, attached []part
+	for _, a := range m.Attachments {
+		if strings.ContainsAny(a.ContentID, "<>\"\\ \t\r\n") {
+			return fmt.Errorf("mailmsg: invalid Content-ID %q", a.ContentID)
+		}
+
+		if a.ContentID != "" {
+			inline = append(inline, attachmentPart(a))
+		} else {
+			attached = append(attached, attachmentPart(a))
+		}
+	}
+
+	if len(inline) > 0 {
+		if body, err = multipartPart("related", append([]part{body}, inline...)); err != nil {
+			return err
+		}
+	}
+
+	if len(attached) > 0 {
+		if body, err = multipartPart("mixed", append([]part{body}, attached...)); err != nil {
+			return err
+		}
+	}
+
+	writeHeader(buf, "Content-Type", body.header.Get("Content-Type"))
+	if cte := body.header.Get("Content-Transfer-Encoding"); cte != "" {
+		writeHeader(buf, "Content-Transfer-Encoding", cte)
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body.body)
+
+	return nil
+}
+
+// alternative returns the text and HTML bodies, wrapped in
+// multipart/alternative when both are present.
+func (m *Message) alternative() (part, error) {
+	var parts []part
+
+	if m.Text != "" {
+		p, err := textPart("text/plain; charset=UTF-8", m.Text)
+		if err != nil {
+			return part{}, err
+		}
+		parts = append(parts, p)
+	}
+
+	if m.HTML != "" {
+		p, err := textPart("text/html; charset=UTF-8", m.HTML)
+		if err != nil {
+			return part{}, err
+		}
+		parts = append(parts, p)
+	}
+
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+
+	return multipartPart("alternative", parts)
+}
+
+func textPart(contentType, body string) (part, error) {
+	var buf bytes.Buffer
+	if err := writeQuotedPrintable(&buf, body); err != nil {
+		return part{}, err
+	}
+
+	return part{
+		header: textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		},
+		body: buf.Bytes(),
+	}, nil
+}
+
+func attachmentPart(a Attachment) part {
+	contentType, params, err := mime.ParseMediaType(a.ContentType)
+	if err != nil {
+		contentType, params = "application/octet-stream", map[string]string{}
+	}
+	params["name"] = a.Filename
+
+	disposition := "attachment"
+	if a.ContentID != "" {
+		disposition = "inline"
+	}
+
+	header := textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType(contentType, params)},
+		"Content-Disposition":       {mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename})},
+		"Content-Transfer-Encoding": {"base64"},
+	}
+
+	if a.ContentID != "" {
+		header.Set("Content-ID", "<"+a.ContentID+">")
+	}
+
+	return part{header: header, body: wrapBase64(a.Data)}
+}
+
+func multipartPart(subtype string, parts []part) (part, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	for _, p := range parts {
+		pw, err := w.CreatePart(p.header)
+		if err != nil {
+			return part{}, err
+		}
+
+		if _, err := pw.Write(p.body); err != nil {
+			return part{}, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return part{}, err
+	}
+
+	return part{
+		header: textproto.MIMEHeader{
+			"Content-Type": {"multipart/" + subtype + "; boundary=\"" + w.Boundary() + "\""},
+		},
+		body: buf.Bytes(),
+	}, nil
+}
+
+// wrapBase64 encodes data as base64 in lines of 76 characters.
+func wrapBase64(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	var buf bytes.Buffer
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76])
+		buf.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded)
+	buf.WriteString("\r\n")
+
+	return buf.Bytes()
+}
+
+func writeQuotedPrintable(w interface{ Write([]byte) (int, error) }, body string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func addressList(addrs []mail.Address) string {
+	list := make([]string, len(addrs))
+	for i, a := range addrs {
+		list[i] = a.String()
+	}
+	return strings.Join(list, ", ")
+}
+
+// writeHeader writes a header field, folding it at whitespace so that no
+// line exceeds 78 characters where possible.
+func writeHeader(buf *bytes.Buffer, name, value string) {
+	line := name + ":"
+	lineLen := len(line)
+
+	for i, word := range strings.Split(value, " ") {
+		if i > 0 && lineLen+1+len(word) > 78 {
+			buf.WriteString(line)
+			buf.WriteString("\r\n")
+			line, lineLen = "", 0
+		}
+
+		line += " " + word
+		lineLen += 1 + len(word)
+	}
+
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// journal is an append-only file of JSON records. Every record is synced to
+// disk before append returns, and the whole file is replayed on open.
+type journal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func openJournal(path string, replay func(line []byte) error) (*journal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %v", err)
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 32*1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		if err := replay(line); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to replay journal %s: %v", path, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read journal %s: %v", path, err)
+	}
+
+	return &journal{path: path, file: f}, nil
+}
+
+func (j *journal) append(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	return j.file.Sync()
+}
+
+// compact replaces the journal contents with records, dropping history that
+// is no longer needed to rebuild the current state.
+func (j *journal) compact(records []any) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	tmp := j.path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+
+	nf, err := os.OpenFile(j.path, os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	j.file.Close()
+	j.file = nf
+
+	return nil
+}
+
+func (j *journal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.file.Close()
+}
@@ -1,34 +1,39 @@
 package main
 
 import (
-	"flag"
 	"log/slog"
 	"os"
-	"strconv"
 	"sync"
 
 	"github.com/go-playground/validator/v10"
 )
 
-type config struct {
-	port int
-	env  string
-	mail struct {
-		host       string
-		port       string
-		user       string
-		pwd        string
-		recipients string
-		allowed_ip string
-	}
-}
-
 type envelope map[string]interface{}
 
 type application struct {
-	config    config
-	wg        sync.WaitGroup
-	validator *validator.Validate
+	config      config
+	wg          sync.WaitGroup
+	validator   *validator.Validate
+	transport   Transport
+	dkim        dkimSigners
+	queue       *queue
+	deadLetters *deadLetterStore
+	statuses    *statusStore
+	addresses   *addressStore
+	suppressed  *suppressionList
+	webhooks    *webhookDispatcher
+	templates   *templateCache
+	apiKeys     *apiKeys
+
+	adminIPs       *ipAllowlist
+	internalIPs    *ipAllowlist
+	trustedProxies *ipAllowlist
+	nonces         *nonceCache
+	spam           *spamFilter
+
+	rateLimitStore  rateLimitStore
+	ipRateLimit     rateLimitPolicy
+	recipientLimits *recipientLimiter
 }
 
 func init() {
@@ -40,30 +45,162 @@ func init() {
 
 func main() {
 
-	var cfg config
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "check" {
+		os.Exit(configCheck(os.Args[3:]))
+	}
+
+	if len(os.Args) > 2 && os.Args[1] == "dkim" && os.Args[2] == "check" {
+		os.Exit(dkimCheck(os.Args[3:]))
+	}
+
+	cfg, _, _, err := loadConfig(os.Args[1:])
+	if err != nil {
+		slog.Error("failed to load configuration", "error", err)
+		os.Exit(2)
+	}
+
+	if err := cfg.validate(); err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
+
+	transport, err := newTransport(cfg)
+	if err != nil {
+		slog.Error("failed to create mail transport", "error", err)
+		os.Exit(1)
+	}
+
+	signers, err := newDKIMSigners(cfg)
+	if err != nil {
+		slog.Error("failed to load DKIM keys", "error", err)
+		os.Exit(1)
+	}
+
+	q, err := openQueue(cfg.queue.dir)
+	if err != nil {
+		slog.Error("failed to open queue", "error", err)
+		os.Exit(1)
+	}
+
+	deadLetters, err := openDeadLetterStore(cfg.queue.dir)
+	if err != nil {
+		slog.Error("failed to open dead letter store", "error", err)
+		os.Exit(1)
+	}
+
+	statuses, err := openStatusStore(cfg.queue.dir, cfg.status.retention)
+	if err != nil {
+		slog.Error("failed to open status store", "error", err)
+		os.Exit(1)
+	}
+
+	addresses, err := openAddressStore(cfg.queue.dir, cfg.bounce.softLimit, cfg.bounce.softWindow)
+	if err != nil {
+		slog.Error("failed to open address store", "error", err)
+		os.Exit(1)
+	}
+
+	suppressed, err := openSuppressionList(cfg.queue.dir)
+	if err != nil {
+		slog.Error("failed to open suppression list", "error", err)
+		os.Exit(1)
+	}
+
+	webhooks, err := openWebhookDispatcher(cfg)
+	if err != nil {
+		slog.Error("failed to open webhook log", "error", err)
+		os.Exit(1)
+	}
 
-	port, err := strconv.Atoi(os.Getenv("PORT"))
+	templates, err := newTemplateCache(cfg.templates.dir)
 	if err != nil {
-		slog.Error("failed to parse port", "error", err)
+		slog.Error("failed to load templates", "error", err)
 		os.Exit(1)
 	}
 
-	flag.IntVar(&cfg.port, "port", port, "Port to listen on")
-	flag.StringVar(&cfg.env, "env", os.Getenv("ENV"), "Environment (development|production)")
-	flag.StringVar(&cfg.mail.host, "MAIL HOST", os.Getenv("EMAIL_HOST"), "MAIL HOST")
-	flag.StringVar(&cfg.mail.port, "MAIL PORT", os.Getenv("EMAIL_PORT"), "MAIL PORT")
-	flag.StringVar(&cfg.mail.user, "MAIL USER ", os.Getenv("EMAIL_USER"), "MAIL USER")
-	flag.StringVar(&cfg.mail.pwd, "MAIL PASSWORD", os.Getenv("EMAIL_PASS"), "MAIL PWD")
-	flag.StringVar(&cfg.mail.recipients, "RECEPIENTS", os.Getenv("RECEPIENTS"), "RECEPIENTS")
-	flag.StringVar(&cfg.mail.allowed_ip, "ALLOWED_IP", os.Getenv("ALLOWED_IP"), "ALLOWED_IP")
+	templates.watch(cfg.templates.reload)
 
-	flag.Parse()
+	keys, err := loadAPIKeys(cfg.auth.keysFile)
+	if err != nil {
+		slog.Error("failed to load api keys", "error", err)
+		os.Exit(1)
+	}
+
+	if !keys.enabled() {
+		slog.Warn("no API keys configured, authentication is disabled")
+	}
+
+	adminIPs, err := parseIPAllowlist(cfg.ip.admin)
+	if err != nil {
+		slog.Error("failed to parse admin allowlist", "error", err)
+		os.Exit(1)
+	}
+
+	internalIPs, err := parseIPAllowlist(cfg.ip.internal)
+	if err != nil {
+		slog.Error("failed to parse internal allowlist", "error", err)
+		os.Exit(1)
+	}
+
+	trustedProxies, err := parseIPAllowlist(cfg.ip.trustedProxies)
+	if err != nil {
+		slog.Error("failed to parse trusted proxies", "error", err)
+		os.Exit(1)
+	}
+
+	spam, err := newSpamFilter(cfg)
+	if err != nil {
+		slog.Error("failed to configure spam filter", "error", err)
+		os.Exit(1)
+	}
+
+	rateLimitStore, err := newRateLimitStore(cfg)
+	if err != nil {
+		slog.Error("failed to create rate limit store", "error", err)
+		os.Exit(1)
+	}
+
+	ipRateLimit, err := parseRateLimitPolicy(cfg.ratelimit.ip)
+	if err != nil {
+		slog.Error("failed to parse ip limit", "error", err)
+		os.Exit(1)
+	}
+
+	policies, err := parseRateLimitPolicies(cfg.ratelimit.recipients)
+	if err != nil {
+		slog.Error("failed to parse recipient limits", "error", err)
+		os.Exit(1)
+	}
 
 	app := &application{
-		config:    cfg,
-		validator: validator.New(),
+		config:      cfg,
+		validator:   validator.New(),
+		transport:   transport,
+		dkim:        signers,
+		queue:       q,
+		deadLetters: deadLetters,
+		statuses:    statuses,
+		addresses:   addresses,
+		suppressed:  suppressed,
+		webhooks:    webhooks,
+		templates:   templates,
+		apiKeys:     keys,
+
+		adminIPs:       adminIPs,
+		internalIPs:    internalIPs,
+		trustedProxies: trustedProxies,
+		nonces:         newNonceCache(cfg.signing.window),
+		spam:           spam,
+
+		rateLimitStore:  rateLimitStore,
+		ipRateLimit:     ipRateLimit,
+		recipientLimits: newRecipientLimiter(rateLimitStore, policies),
 	}
 
+	webhooks.resume()
+	app.startWorkers(cfg.queue.workers)
+	app.startBouncePollers()
+
 	err = app.serve()
 	if err != nil {
 		slog.Error("error starting server", "error", err)
@@ -2,19 +2,113 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
+	"strings"
 
 	"github.com/labstack/echo/v4"
 )
 
-func (app *application) FilterIPAddress (next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
+// ipAllowlist is a set of IPv4 and IPv6 addresses and CIDR ranges.
+type ipAllowlist struct {
+	prefixes []netip.Prefix
+}
+
+// parseIPAllowlist parses a comma-separated list such as
+// "10.0.0.0/8, 203.0.113.7, 2001:db8::/32".
+func parseIPAllowlist(s string) (*ipAllowlist, error) {
+	l := &ipAllowlist{}
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if strings.Contains(item, "/") {
+			p, err := netip.ParsePrefix(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %v", item, err)
+			}
+			l.prefixes = append(l.prefixes, p.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address %q: %v", item, err)
+		}
+		addr = addr.Unmap()
+		l.prefixes = append(l.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+
+	return l, nil
+}
+
+func (l *ipAllowlist) empty() bool {
+	return len(l.prefixes) == 0
+}
+
+func (l *ipAllowlist) contains(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
 
-		if c.RealIP() != app.config.mail.allowed_ip {
-			return echo.NewHTTPError(http.StatusUnauthorized,
-				fmt.Sprintf("IP address %s not allowed", c.RealIP()))
+	for _, p := range l.prefixes {
+		if p.Contains(addr) {
+			return true
 		}
+	}
+	return false
+}
+
+// ipNets returns the allowlist in the form echo's IP extractors expect.
+func (l *ipAllowlist) ipNets() []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(l.prefixes))
+	for _, p := range l.prefixes {
+		nets = append(nets, &net.IPNet{
+			IP:   net.IP(p.Addr().AsSlice()),
+			Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen()),
+		})
+	}
+	return nets
+}
+
+// FilterIPAddress only lets through requests whose client IP is in allowed.
+// An empty allowlist rejects everything.
+func (app *application) FilterIPAddress(allowed *ipAllowlist) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
 
-		return next(c)
+			if !allowed.contains(c.RealIP()) {
+				return c.JSON(http.StatusForbidden,
+					envelope{"error": fmt.Sprintf("IP address %s not allowed", c.RealIP())})
+			}
+
+			return next(c)
+		}
 	}
 }
+
+// ipExtractor decides how echo derives the client IP. Forwarding headers are
+// only honoured when the direct peer is one of the trusted proxies, so
+// clients cannot pick their own address via X-Forwarded-For.
+func ipExtractor(trustedProxies *ipAllowlist) echo.IPExtractor {
+	if trustedProxies.empty() {
+		return echo.ExtractIPDirect()
+	}
+
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, n := range trustedProxies.ipNets() {
+		options = append(options, echo.TrustIPRange(n))
+	}
+
+	return echo.ExtractIPFromXFFHeader(options...)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// mxResolver finds the mail exchangers for a domain. *net.Resolver
+// satisfies it.
+type mxResolver interface {
+	LookupMX(ctx context.Context, domain string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// staticResolver answers from a fixed table before falling back to another
+// resolver. Hosts may carry a port, which is used instead of mx.port.
+type staticResolver struct {
+	hosts map[string][]*net.MX
+	next  mxResolver
+}
+
+// parseStaticMX reads "domain=host[:port] host2,domain2=host3" entries.
+// Hosts listed first get the lower preference.
+func parseStaticMX(s string) (map[string][]*net.MX, error) {
+	hosts := make(map[string][]*net.MX)
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		domain, list, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(domain) == "" || len(strings.Fields(list)) == 0 {
+			return nil, fmt.Errorf("invalid entry %q, want domain=host", item)
+		}
+
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		for i, host := range strings.Fields(list) {
+			hosts[domain] = append(hosts[domain], &net.MX{Host: host, Pref: uint16(i * 10)})
+		}
+	}
+
+	return hosts, nil
+}
+
+func (r *staticResolver) LookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	if mxs, ok := r.hosts[domain]; ok {
+		return mxs, nil
+	}
+	return r.next.LookupMX(ctx, domain)
+}
+
+func (r *staticResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return r.next.LookupHost(ctx, host)
+}
+
+// mxTransport delivers straight to each recipient domain's mail exchangers.
+// Exchangers are tried in preference order until one answers; a 4xx reply
+// after the greeting is taken as greylisting and the recipients it covers
+// are deferred. Each phase of a session must finish within timeout.
+type mxTransport struct {
+	resolver      mxResolver
+	port          string
+	helo          string
+	tlsMode       string
+	greylistDelay time.Duration
+	timeout       time.Duration
+}
+
+func newMXTransport(cfg config) (*mxTransport, error) {
+	static, err := parseStaticMX(cfg.mx.hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	helo := cfg.mx.helo
+	if helo == "" {
+		helo = cfg.mail.domain
+	}
+
+	return &mxTransport{
+		resolver:      &staticResolver{hosts: static, next: net.DefaultResolver},
+		port:          cfg.mx.port,
+		helo:          helo,
+		tlsMode:       cfg.mx.tls,
+		greylistDelay: cfg.mx.greylistDelay,
+		timeout:       cfg.mx.timeout,
+	}, nil
+}
+
+func (t *mxTransport) Send(from string, to []string, msg []byte) error {
+	var domains []string
+	byDomain := make(map[string][]string)
+	for _, addr := range to {
+		_, domain, _ := strings.Cut(addr, "@")
+		domain = strings.ToLower(domain)
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], addr)
+	}
+
+	var res mxResult
+	for _, domain := range domains {
+		t.deliverDomain(domain, from, byDomain[domain], msg, &res)
+	}
+
+	return res.err()
+}
+
+// mxResult collects what became of each recipient of a message.
+type mxResult struct {
+	delivered []string
+	rejected  []string
+	permanent []error
+	transient []error
+}
+
+// err reports the outcome as Send returns it: nil when every recipient
+// was delivered, a *deliveryError when some were delivered or rejected and
+// others are left, and the bare error otherwise.
+func (r *mxResult) err() error {
+	if len(r.permanent) == 0 && len(r.transient) == 0 {
+		return nil
+	}
+
+	// Report a permanent failure only when nothing is left to retry.
+	err := errors.Join(r.transient...)
+	if len(r.transient) == 0 {
+		err = errors.Join(r.permanent...)
+	} else if len(r.permanent) > 0 {
+		err = fmt.Errorf("%w (also rejected: %v)", err, errors.Join(r.permanent...))
+	}
+
+	if len(r.delivered) == 0 && (len(r.transient) == 0 || len(r.rejected) == 0) {
+		return err
+	}
+
+	return &deliveryError{Delivered: r.delivered, Rejected: r.rejected, Err: err}
+}
+
+// settle records err as the outcome for rcpts. A 4xx reply after the
+// greeting is taken as greylisting and deferred for at least greylistDelay.
+func (t *mxTransport) settle(res *mxResult, who string, rcpts []string, err error) {
+	err = fmt.Errorf("%s: %w", who, err)
+
+	var tpErr *textproto.Error
+	switch {
+	case isPermanent(err):
+		res.rejected = append(res.rejected, rcpts...)
+		res.permanent = append(res.permanent, err)
+	case errors.As(err, &tpErr):
+		res.transient = append(res.transient, &deferralError{Err: err, Delay: t.greylistDelay})
+	default:
+		res.transient = append(res.transient, err)
+	}
+}
+
+func (t *mxTransport) exchangers(domain string) ([]*net.MX, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), smtpDialTimeout)
+	defer cancel()
+
+	mxs, err := t.resolver.LookupMX(ctx, domain)
+
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return nil, err
+	}
+
+	// RFC 7505 null MX: the domain accepts no mail.
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, &textproto.Error{Code: 556, Msg: "domain does not accept mail"}
+	}
+
+	if len(mxs) > 0 {
+		sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+		return mxs, nil
+	}
+
+	// Without MX records the domain itself is the exchanger (RFC 5321 5.1).
+	if _, err := t.resolver.LookupHost(ctx, domain); err != nil {
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, &textproto.Error{Code: 550, Msg: "no mail exchanger for domain"}
+		}
+		return nil, err
+	}
+
+	return []*net.MX{{Host: domain}}, nil
+}
+
+func (t *mxTransport) deliverDomain(domain, from string, rcpts []string, msg []byte, res *mxResult) {
+	mxs, err := t.exchangers(domain)
+	if err != nil {
+		t.settle(res, domain, rcpts, err)
+		return
+	}
+
+	for _, mx := range mxs {
+		client, conn, cerr := t.connect(strings.TrimSuffix(mx.Host, "."))
+		if cerr != nil {
+			err = cerr
+			continue
+		}
+
+		conn.SetDeadline(time.Now().Add(t.timeout))
+
+		rcpts, err = t.transact(client, from, rcpts, msg, res)
+		if err == nil {
+			conn.SetDeadline(time.Now().Add(t.timeout))
+			client.Quit()
+			return
+		}
+		client.Close()
+	}
+
+	if len(rcpts) > 0 {
+		t.settle(res, domain, rcpts, err)
+	}
+}
+
+// transact sends msg over one session, settling each recipient the
+// exchanger answered for: a rejected mailbox does not hold back the others.
+// When the session breaks down it returns the recipients still undecided,
+// to be tried at the next exchanger.
+func (t *mxTransport) transact(client *smtp.Client, from string, rcpts []string, msg []byte, res *mxResult) ([]string, error) {
+	var tpErr *textproto.Error
+
+	if err := client.Mail(from); err != nil {
+		if errors.As(err, &tpErr) {
+			t.settle(res, "MAIL FROM", rcpts, err)
+			return nil, nil
+		}
+		return rcpts, err
+	}
+
+	var accepted []string
+	for i, addr := range rcpts {
+		err := client.Rcpt(addr)
+		switch {
+		case err == nil:
+			accepted = append(accepted, addr)
+		case errors.As(err, &tpErr):
+			t.settle(res, addr, []string{addr}, err)
+		default:
+			return append(accepted, rcpts[i:]...), err
+		}
+	}
+
+	if len(accepted) == 0 {
+		return nil, nil
+	}
+
+	err := func() error {
+		w, err := client.Data()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(msg); err != nil {
+			return err
+		}
+		return w.Close()
+	}()
+
+	switch {
+	case err == nil:
+		res.delivered = append(res.delivered, accepted...)
+		return nil, nil
+	case errors.As(err, &tpErr):
+		t.settle(res, "DATA", accepted, err)
+		return nil, nil
+	default:
+		return accepted, err
+	}
+}
+
+// connect opens a session with one exchanger, up to and including
+// STARTTLS. Certificates are only verified in starttls-required mode, as
+// most exchangers present certificates that do not match their MX name.
+func (t *mxTransport) connect(host string) (*smtp.Client, net.Conn, error) {
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		addr = net.JoinHostPort(host, t.port)
+	} else {
+		host, _, _ = net.SplitHostPort(host)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, smtpDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Tarpitting exchangers stall the greeting; bound the whole setup.
+	conn.SetDeadline(time.Now().Add(t.timeout))
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if err := client.Hello(t.helo); err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+
+	if t.tlsMode != smtpTLSNone {
+		ok, _ := client.Extension("STARTTLS")
+		if !ok && t.tlsMode == smtpTLSRequired {
+			client.Close()
+			return nil, nil, fmt.Errorf("%s does not offer STARTTLS, which is required", addr)
+		}
+
+		if ok {
+			tlsCfg := &tls.Config{
+				ServerName:         host,
+				MinVersion:         tls.VersionTLS12,
+				InsecureSkipVerify: t.tlsMode != smtpTLSRequired,
+			}
+			if err := client.StartTLS(tlsCfg); err != nil {
+				client.Close()
+				return nil, nil, fmt.Errorf("STARTTLS with %s failed: %v", addr, err)
+			}
+		}
+	}
+
+	return client, conn, nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var errQueueClosed = errors.New("queue is closed")
+
+type message struct {
+	ID          string    `json:"id"`
+	Template    string    `json:"template,omitempty"`
+	From        string    `json:"from"`
+	To          []string  `json:"to"`
+	Data        []byte    `json:"data"`
+	CreatedAt   time.Time `json:"created_at"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error,omitempty"`
+	NextAttempt time.Time `json:"next_attempt,omitempty"`
+}
+
+type queueRecord struct {
+	Op  string   `json:"op"`
+	ID  string   `json:"id"`
+	Msg *message `json:"msg,omitempty"`
+}
+
+// queue is a durable FIFO of outbound messages. A message stays in the
+// journal until a worker reports it done, so anything still pending when the
+// process stops is picked up again on the next start.
+type queue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	journal *journal
+	pending map[string]*message
+	ready   []string
+	closed  bool
+}
+
+func openQueue(dir string) (*queue, error) {
+	q := &queue{pending: make(map[string]*message)}
+	q.cond = sync.NewCond(&q.mu)
+
+	j, err := openJournal(filepath.Join(dir, "queue.log"), func(line []byte) error {
+		var r queueRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return err
+		}
+
+		switch r.Op {
+		case "put":
+			if _, ok := q.pending[r.ID]; !ok {
+				q.ready = append(q.ready, r.ID)
+			}
+			q.pending[r.ID] = r.Msg
+		case "done":
+			delete(q.pending, r.ID)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q.journal = j
+
+	ids := q.ready
+	q.ready = nil
+	records := make([]any, 0, len(q.pending))
+	for _, id := range ids {
+		msg, ok := q.pending[id]
+		if !ok {
+			continue
+		}
+
+		records = append(records, queueRecord{Op: "put", ID: id, Msg: msg})
+
+		if delay := time.Until(msg.NextAttempt); delay > 0 {
+			q.schedule(id, delay)
+		} else {
+			q.ready = append(q.ready, id)
+		}
+	}
+
+	if err := j.compact(records); err != nil {
+		j.close()
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (q *queue) push(msg *message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return errQueueClosed
+	}
+
+	if err := q.journal.append(queueRecord{Op: "put", ID: msg.ID, Msg: msg}); err != nil {
+		return err
+	}
+
+	q.pending[msg.ID] = msg
+	q.ready = append(q.ready, msg.ID)
+	q.cond.Signal()
+
+	return nil
+}
+
+// next blocks until a message is ready or the queue is closed.
+func (q *queue) next() (*message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.ready) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+
+	if q.closed {
+		return nil, false
+	}
+
+	id := q.ready[0]
+	q.ready = q.ready[1:]
+
+	return q.pending[id], true
+}
+
+// retry stores the updated message and makes it ready again at msg.NextAttempt.
+func (q *queue) retry(msg *message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.journal.append(queueRecord{Op: "put", ID: msg.ID, Msg: msg}); err != nil {
+		return err
+	}
+
+	q.pending[msg.ID] = msg
+	q.schedule(msg.ID, time.Until(msg.NextAttempt))
+
+	return nil
+}
+
+func (q *queue) schedule(id string, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		if _, ok := q.pending[id]; !ok || q.closed {
+			return
+		}
+
+		q.ready = append(q.ready, id)
+		q.cond.Signal()
+	})
+}
+
+func (q *queue) done(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.pending, id)
+
+	return q.journal.append(queueRecord{Op: "done", ID: id})
+}
+
+// close stops handing out messages. Messages that have not been picked up
+// stay in the journal.
+func (q *queue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	q.cond.Broadcast()
+}
+
+func newMessageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (app *application) enqueue(id, template, from string, to []string, data []byte) error {
+	msg := &message{
+		ID:        id,
+		Template:  template,
+		From:      from,
+		To:        to,
+		Data:      data,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	app.setStatus(msg, statusQueued, "")
+
+	if err := app.queue.push(msg); err != nil {
+		app.setStatus(msg, statusFailed, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func (app *application) setStatus(msg *message, status, response string) {
+	if err := app.statuses.update(msg, status, response); err != nil {
+		slog.Error("failed to record message status", "id", msg.ID, "status", status, "error", err)
+	}
+}
+
+func (app *application) startWorkers(n int) {
+	for i := 0; i < n; i++ {
+		app.wg.Add(1)
+		go func() {
+			defer app.wg.Done()
+
+			for {
+				msg, ok := app.queue.next()
+				if !ok {
+					return
+				}
+
+				app.deliver(msg)
+			}
+		}()
+	}
+}
+
+func (app *application) deliver(msg *message) {
+	// Recipients suppressed since the message was queued are dropped.
+	var supErr *suppressedError
+	if errors.As(app.suppressed.check(msg.To), &supErr) {
+		dropped := supErr.addresses()
+		msg.To = without(msg.To, dropped)
+		msg.LastError = supErr.Error()
+
+		slog.Warn("dropping suppressed recipients", "id", msg.ID, "recipients", dropped)
+		app.notify(eventFailed, msg, dropped)
+
+		if len(msg.To) == 0 {
+			app.setStatus(msg, statusFailed, msg.LastError)
+
+			if err := app.queue.done(msg.ID); err != nil {
+				slog.Error("failed to update queue", "id", msg.ID, "error", err)
+			}
+			return
+		}
+	}
+
+	msg.Attempts++
+	app.setStatus(msg, statusSending, "")
+
+	err := app.transportFor(msg).Send(msg.From, msg.To, msg.Data)
+	if err == nil {
+		slog.Info("email sent", "id", msg.ID, "attempts", msg.Attempts)
+		app.setStatus(msg, statusSent, "")
+		app.notify(eventSent, msg, msg.To)
+
+		if err := app.queue.done(msg.ID); err != nil {
+			slog.Error("failed to update queue", "id", msg.ID, "error", err)
+		}
+		return
+	}
+
+	msg.LastError = err.Error()
+
+	// Recipients that were delivered are done with, whatever happens to the
+	// rest of the message.
+	var partial *deliveryError
+	if errors.As(err, &partial) && len(partial.Delivered) > 0 {
+		msg.To = without(msg.To, partial.Delivered)
+		slog.Warn("email partially delivered", "id", msg.ID, "delivered", partial.Delivered, "rejected", partial.Rejected)
+		app.notify(eventSent, msg, partial.Delivered)
+	}
+
+	if isPermanent(err) || msg.Attempts >= app.config.retry.maxAttempts {
+		slog.Error("email failed permanently", "id", msg.ID, "attempts", msg.Attempts, "error", err)
+		app.setStatus(msg, statusFailed, msg.LastError)
+		app.notify(eventFailed, msg, msg.To)
+
+		if err := app.deadLetters.put(msg); err != nil {
+			slog.Error("failed to store dead letter", "id", msg.ID, "error", err)
+			return
+		}
+
+		if err := app.queue.done(msg.ID); err != nil {
+			slog.Error("failed to update queue", "id", msg.ID, "error", err)
+		}
+		return
+	}
+
+	if partial != nil && len(partial.Rejected) > 0 {
+		msg.To = without(msg.To, partial.Rejected)
+		app.notify(eventFailed, msg, partial.Rejected)
+	}
+
+	delay := backoff(msg.Attempts, app.config.retry.baseDelay, app.config.retry.maxDelay)
+
+	var deferral interface{ retryDelay() time.Duration }
+	if errors.As(err, &deferral) && deferral.retryDelay() > delay {
+		delay = deferral.retryDelay()
+	}
+
+	msg.NextAttempt = time.Now().Add(delay).UTC()
+
+	slog.Warn("email deferred", "id", msg.ID, "attempts", msg.Attempts, "retry_in", delay.String(), "error", err)
+	app.setStatus(msg, statusDeferred, msg.LastError)
+	app.notify(eventDeferred, msg, msg.To)
+
+	if err := app.queue.retry(msg); err != nil {
+		slog.Error("failed to update queue", "id", msg.ID, "error", err)
+	}
+}
+
+func without(list, remove []string) []string {
+	drop := make(map[string]bool, len(remove))
+	for _, r := range remove {
+		drop[r] = true
+	}
+
+	var kept []string
+	for _, item := range list {
+		if !drop[item] {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitPolicy allows limit hits per window.
+type rateLimitPolicy struct {
+	limit  int
+	window time.Duration
+}
+
+// parseRateLimitPolicy parses "<limit>/<window>", for example "3/1h".
+func parseRateLimitPolicy(rule string) (rateLimitPolicy, error) {
+	limit, window, ok := strings.Cut(strings.TrimSpace(rule), "/")
+	if !ok {
+		return rateLimitPolicy{}, fmt.Errorf("invalid rate limit %q", rule)
+	}
+
+	n, err := strconv.Atoi(limit)
+	if err != nil || n <= 0 {
+		return rateLimitPolicy{}, fmt.Errorf("invalid limit in rate limit %q", rule)
+	}
+
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return rateLimitPolicy{}, fmt.Errorf("invalid window in rate limit %q", rule)
+	}
+
+	return rateLimitPolicy{limit: n, window: d}, nil
+}
+
+// parseRateLimitPolicies parses a comma-separated list of
+// <template>=<limit>/<window> entries such as "pwdreset=3/1h,*=20/24h".
+// The "*" entry applies to templates without a policy of their own.
+func parseRateLimitPolicies(s string) (map[string]rateLimitPolicy, error) {
+	policies := make(map[string]rateLimitPolicy)
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, rule, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit policy %q", item)
+		}
+
+		p, err := parseRateLimitPolicy(rule)
+		if err != nil {
+			return nil, err
+		}
+
+		policies[strings.TrimSpace(name)] = p
+	}
+
+	return policies, nil
+}
+
+// rateLimitStore keeps fixed-window hit counters. Sharing a store between
+// instances shares their limits.
+type rateLimitStore interface {
+	// Incr adds a hit to key, starting a new window of the given length if
+	// none is open, and returns the hits so far and the time left in the
+	// window.
+	Incr(key string, window time.Duration) (int64, time.Duration, error)
+}
+
+func newRateLimitStore(cfg config) (rateLimitStore, error) {
+	switch cfg.ratelimit.store {
+	case "", "memory":
+		return newMemoryRateLimitStore(), nil
+	case "redis":
+		if cfg.ratelimit.redisAddr == "" {
+			return nil, fmt.Errorf("redis rate limit store requires an address")
+		}
+		if cfg.ratelimit.redisPool <= 0 {
+			return nil, fmt.Errorf("ratelimit.redis_pool must be positive")
+		}
+		return &redisRateLimitStore{
+			client: newRedisClient(cfg.ratelimit.redisAddr, cfg.ratelimit.redisPassword, cfg.ratelimit.redisDB, cfg.ratelimit.redisPool),
+			prefix: "mailer:ratelimit:",
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", cfg.ratelimit.store)
+	}
+}
+
+type windowCount struct {
+	expires time.Time
+	count   int64
+}
+
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	windows map[string]*windowCount
+	swept   time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{windows: make(map[string]*windowCount)}
+}
+
+func (s *memoryRateLimitStore) Incr(key string, window time.Duration) (int64, time.Duration, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.swept) > time.Minute {
+		for k, w := range s.windows {
+			if !now.Before(w.expires) {
+				delete(s.windows, k)
+			}
+		}
+		s.swept = now
+	}
+
+	w, ok := s.windows[key]
+	if !ok || !now.Before(w.expires) {
+		w = &windowCount{expires: now.Add(window)}
+		s.windows[key] = w
+	}
+
+	w.count++
+
+	return w.count, w.expires.Sub(now), nil
+}
+
+// redisRateLimitStore keeps counters in Redis as keys that expire with their
+// window.
+type redisRateLimitStore struct {
+	client *redisClient
+	prefix string
+}
+
+func (s *redisRateLimitStore) Incr(key string, window time.Duration) (int64, time.Duration, error) {
+	key = s.prefix + key
+	ms := strconv.FormatInt(window.Milliseconds(), 10)
+
+	replies, err := s.client.pipeline(
+		[]string{"INCR", key},
+		[]string{"PTTL", key},
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, r := range replies {
+		if rerr, ok := r.(redisError); ok {
+			return 0, 0, rerr
+		}
+	}
+
+	count, _ := replies[0].(int64)
+	ttl, _ := replies[1].(int64)
+
+	// A key without an expiry was just created, or its creator died before
+	// setting one.
+	if ttl < 0 {
+		if _, err := s.client.do("PEXPIRE", key, ms); err != nil {
+			return 0, 0, err
+		}
+		ttl = window.Milliseconds()
+	}
+
+	return count, time.Duration(ttl) * time.Millisecond, nil
+}
+
+// ipRateLimiter adapts a rateLimitStore to echo's rate limiter middleware.
+type ipRateLimiter struct {
+	store  rateLimitStore
+	policy rateLimitPolicy
+}
+
+// Allow lets the request through when the store cannot be reached, rather
+// than turning a store outage into an outage of every endpoint.
+func (l *ipRateLimiter) Allow(identifier string) (bool, error) {
+	count, _, err := l.store.Incr("ip:"+identifier, l.policy.window)
+	if err != nil {
+		slog.Warn("rate limit store unavailable, allowing request", "ip", identifier, "error", err)
+		return true, nil
+	}
+	return count <= int64(l.policy.limit), nil
+}
+
+type rateLimitError struct {
+	recipient  string
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded for %s, retry in %s", e.recipient, e.retryAfter.Round(time.Second))
+}
+
+// recipientLimiter limits sends per template and recipient address.
+type recipientLimiter struct {
+	store    rateLimitStore
+	policies map[string]rateLimitPolicy
+}
+
+func newRecipientLimiter(store rateLimitStore, policies map[string]rateLimitPolicy) *recipientLimiter {
+	return &recipientLimiter{store: store, policies: policies}
+}
+
+func (rl *recipientLimiter) policy(template string) (rateLimitPolicy, bool) {
+	if p, ok := rl.policies[template]; ok {
+		return p, true
+	}
+	p, ok := rl.policies["*"]
+	return p, ok
+}
+
+// allow counts a send of template to every recipient and returns a
+// *rateLimitError for the first recipient over its limit. Recipients are
+// let through when the store cannot be reached.
+func (rl *recipientLimiter) allow(template string, recipients []string) error {
+	p, ok := rl.policy(template)
+	if !ok {
+		return nil
+	}
+
+	for _, r := range recipients {
+		key := "rcpt:" + template + ":" + strings.ToLower(strings.TrimSpace(r))
+
+		count, ttl, err := rl.store.Incr(key, p.window)
+		if err != nil {
+			slog.Warn("rate limit store unavailable, allowing recipient", "template", template, "error", err)
+			continue
+		}
+
+		if count > int64(p.limit) {
+			return &rateLimitError{recipient: r, retryAfter: ttl}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisClient speaks just enough RESP to run commands against a Redis
+// compatible server. It keeps up to cap(slots) connections, each serving one
+// command or pipeline at a time. A connection is dropped on any I/O error
+// and a new one dialled by the next command.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	slots    chan struct{}
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func newRedisClient(addr, password string, db, size int) *redisClient {
+	return &redisClient{
+		addr:     addr,
+		password: password,
+		db:       db,
+		timeout:  2 * time.Second,
+		slots:    make(chan struct{}, size),
+	}
+}
+
+func (c *redisClient) connect() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &redisConn{conn: conn, rd: bufio.NewReader(conn)}
+
+	var setup [][]string
+	if c.password != "" {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+
+	if len(setup) == 0 {
+		return rc, nil
+	}
+
+	replies, err := rc.roundTrip(setup, c.timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	for _, r := range replies {
+		if rerr, ok := r.(redisError); ok {
+			conn.Close()
+			return nil, rerr
+		}
+	}
+
+	return rc, nil
+}
+
+// get takes an idle connection, or dials a new one.
+func (c *redisClient) get() (*redisConn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		rc := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return rc, nil
+	}
+	c.mu.Unlock()
+
+	return c.connect()
+}
+
+func (c *redisClient) put(rc *redisConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.idle = append(c.idle, rc)
+}
+
+// pipeline sends every command before reading any reply and returns the
+// replies in order. A reply that is a Redis error is returned as a
+// redisError value in the slice.
+func (c *redisClient) pipeline(cmds ...[]string) ([]any, error) {
+	c.slots <- struct{}{}
+	defer func() { <-c.slots }()
+
+	rc, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := rc.roundTrip(cmds, c.timeout)
+	if err != nil {
+		rc.conn.Close()
+		return nil, err
+	}
+
+	c.put(rc)
+
+	return replies, nil
+}
+
+func (c *redisClient) do(args ...string) (any, error) {
+	replies, err := c.pipeline(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if rerr, ok := replies[0].(redisError); ok {
+		return nil, rerr
+	}
+
+	return replies[0], nil
+}
+
+func (rc *redisConn) roundTrip(cmds [][]string, timeout time.Duration) ([]any, error) {
+	rc.conn.SetDeadline(time.Now().Add(timeout))
+
+	w := bufio.NewWriter(rc.conn)
+	for _, args := range cmds {
+		fmt.Fprintf(w, "*%d\r\n", len(args))
+		for _, a := range args {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(a), a)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]any, len(cmds))
+	for i := range cmds {
+		r, err := readReply(rc.rd)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = r
+	}
+
+	return replies, nil
+}
+
+func readReply(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	payload := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return payload, nil
+	case '-':
+		return redisError(payload), nil
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readReply(rd); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", line[0])
+	}
+}
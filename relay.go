@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errNoHealthyRelay = errors.New("no healthy relay available")
+
+// relayConfig describes one SMTP relay in the config file. Relays with a
+// lower priority are tried first; relays sharing a priority are picked at
+// random in proportion to their weight.
+type relayConfig struct {
+	Name     string `yaml:"name"`
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Priority int    `yaml:"priority"`
+	Weight   int    `yaml:"weight"`
+
+	TLS           string `yaml:"tls"`
+	TLSMinVersion string `yaml:"tls_min_version"`
+	CAFile        string `yaml:"ca_file"`
+	CertFile      string `yaml:"cert_file"`
+	KeyFile       string `yaml:"key_file"`
+	ServerName    string `yaml:"server_name"`
+
+	Auth              string `yaml:"auth"`
+	OAuthTokenURL     string `yaml:"oauth_token_url"`
+	OAuthClientID     string `yaml:"oauth_client_id"`
+	OAuthClientSecret string `yaml:"oauth_client_secret"`
+	OAuthRefreshToken string `yaml:"oauth_refresh_token"`
+}
+
+// relayConfigs returns the configured relays with unset TLS and auth
+// options taken from the smtp.* settings. Relays without a user default to
+// no authentication. Without a relays section the smtp.* settings
+// form a single relay named "default".
+func (cfg config) relayConfigs() []relayConfig {
+	relays := append([]relayConfig(nil), cfg.relays...)
+	if len(relays) == 0 {
+		relays = []relayConfig{{
+			Name:     "default",
+			Host:     cfg.mail.host,
+			Port:     cfg.mail.port,
+			User:     cfg.mail.user,
+			Password: cfg.mail.pwd,
+		}}
+	}
+
+	for i := range relays {
+		rc := &relays[i]
+		if rc.TLS == "" {
+			rc.TLS = cfg.tls.mode
+		}
+		if rc.TLSMinVersion == "" {
+			rc.TLSMinVersion = cfg.tls.minVersion
+		}
+		if rc.CAFile == "" {
+			rc.CAFile = cfg.tls.caFile
+		}
+		if rc.CertFile == "" && rc.KeyFile == "" {
+			rc.CertFile = cfg.tls.certFile
+			rc.KeyFile = cfg.tls.keyFile
+		}
+		if rc.ServerName == "" && len(cfg.relays) == 0 {
+			rc.ServerName = cfg.tls.serverName
+		}
+		if rc.Auth == "" {
+			rc.Auth = cfg.mail.auth
+			if rc.User == "" {
+				rc.Auth = smtpAuthNone
+			}
+		}
+		if rc.OAuthTokenURL == "" {
+			rc.OAuthTokenURL = cfg.oauth.tokenURL
+			rc.OAuthClientID = cfg.oauth.clientID
+			rc.OAuthClientSecret = cfg.oauth.clientSecret
+			rc.OAuthRefreshToken = cfg.oauth.refreshToken
+		}
+	}
+
+	return relays
+}
+
+// circuitBreaker opens after a run of consecutive failures and lets a single
+// trial request through once the cooldown has passed.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+
+	if now.Before(b.openUntil) || b.trial {
+		return false
+	}
+
+	b.trial = true
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.trial = false
+}
+
+func (b *circuitBreaker) failure(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+	if b.failures >= b.threshold {
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
+
+type relay struct {
+	name      string
+	priority  int
+	weight    int
+	transport Transport
+	breaker   *circuitBreaker
+}
+
+// relayPool sends through the first relay that accepts the message, in
+// priority and weighted order. Permanent rejections are returned at once,
+// since another relay would refuse the same message.
+type relayPool struct {
+	relays []*relay
+}
+
+func (p *relayPool) order() []*relay {
+	ordered := make([]*relay, 0, len(p.relays))
+
+	byPriority := make(map[int][]*relay)
+	var priorities []int
+	for _, r := range p.relays {
+		if _, ok := byPriority[r.priority]; !ok {
+			priorities = append(priorities, r.priority)
+		}
+		byPriority[r.priority] = append(byPriority[r.priority], r)
+	}
+	sort.Ints(priorities)
+
+	for _, prio := range priorities {
+		group := append([]*relay(nil), byPriority[prio]...)
+
+		for len(group) > 0 {
+			total := 0
+			for _, r := range group {
+				total += r.weight
+			}
+
+			pick := rand.IntN(total)
+			for i, r := range group {
+				if pick < r.weight {
+					ordered = append(ordered, r)
+					group = append(group[:i], group[i+1:]...)
+					break
+				}
+				pick -= r.weight
+			}
+		}
+	}
+
+	return ordered
+}
+
+func (p *relayPool) Send(from string, to []string, msg []byte) error {
+	lastErr := errNoHealthyRelay
+
+	for _, r := range p.order() {
+		now := time.Now()
+		if !r.breaker.allow(now) {
+			continue
+		}
+
+		err := r.transport.Send(from, to, msg)
+		if err == nil {
+			r.breaker.success()
+			return nil
+		}
+
+		if isPermanent(err) {
+			r.breaker.success()
+			return err
+		}
+
+		r.breaker.failure(now)
+		slog.Warn("relay failed, trying next", "relay", r.name, "error", err)
+		lastErr = fmt.Errorf("relay %s: %w", r.name, err)
+	}
+
+	return lastErr
+}
+
+// relayRouter picks the relay pool for a template. Templates without a
+// routing rule use the "*" rule, or every relay when there is none.
+type relayRouter struct {
+	relays   []*relay
+	routes   map[string]*relayPool
+	fallback *relayPool
+}
+
+func newRelayRouter(cfg config) (*relayRouter, error) {
+	relays := make(map[string]*relay)
+	all := &relayPool{}
+
+	for _, rc := range cfg.relayConfigs() {
+		weight := rc.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+
+		transport, err := newSMTPTransport(rc, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("relay %s: %v", rc.Name, err)
+		}
+
+		r := &relay{
+			name:      rc.Name,
+			priority:  rc.Priority,
+			weight:    weight,
+			transport: transport,
+			breaker: &circuitBreaker{
+				threshold: cfg.breaker.failures,
+				cooldown:  cfg.breaker.cooldown,
+			},
+		}
+
+		relays[rc.Name] = r
+		all.relays = append(all.relays, r)
+	}
+
+	router := &relayRouter{relays: all.relays, routes: make(map[string]*relayPool), fallback: all}
+
+	for template, names := range cfg.routing {
+		pool := &relayPool{}
+		for _, name := range names {
+			r, ok := relays[name]
+			if !ok {
+				return nil, fmt.Errorf("routing for %q refers to unknown relay %q", template, name)
+			}
+			pool.relays = append(pool.relays, r)
+		}
+
+		if template == "*" {
+			router.fallback = pool
+		} else {
+			router.routes[template] = pool
+		}
+	}
+
+	return router, nil
+}
+
+func (rr *relayRouter) route(template string) Transport {
+	if pool, ok := rr.routes[template]; ok {
+		return pool
+	}
+	return rr.fallback
+}
+
+func (rr *relayRouter) Send(from string, to []string, msg []byte) error {
+	return rr.fallback.Send(from, to, msg)
+}
+
+// Close closes the connections held by every relay.
+func (rr *relayRouter) Close() error {
+	for _, r := range rr.relays {
+		if c, ok := r.transport.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	return nil
+}
+
+// transportFor returns the transport that should carry msg, taking template
+// routing into account when relays are in use.
+func (app *application) transportFor(msg *message) Transport {
+	if rr, ok := app.transport.(*relayRouter); ok {
+		return rr.route(msg.Template)
+	}
+	return app.transport
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// isPermanent reports whether retrying err is pointless. Only 5xx SMTP
+// replies to the message itself are permanent; 4xx replies, session setup
+// failures, timeouts, resets and anything we cannot classify are retried
+// until the attempt limit is reached.
+func isPermanent(err error) bool {
+	var sErr *sessionError
+	if errors.As(err, &sErr) {
+		return false
+	}
+
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code >= 500
+	}
+
+	return false
+}
+
+// sessionError reports a failure to set up a session with a server:
+// connecting, the greeting, STARTTLS or AUTH. It says nothing about the
+// message, so it is never permanent, even when the server answered 5xx.
+type sessionError struct {
+	Err error
+}
+
+func (e *sessionError) Error() string { return e.Err.Error() }
+
+func (e *sessionError) Unwrap() error { return e.Err }
+
+// deliveryError reports a send that reached some recipients but not all.
+// Delivered and Rejected recipients must not be sent to again; Err says what
+// happened to the rest.
+type deliveryError struct {
+	Delivered []string
+	Rejected  []string
+	Err       error
+}
+
+func (e *deliveryError) Error() string {
+	return fmt.Sprintf("delivered to %d of the recipients: %v", len(e.Delivered), e.Err)
+}
+
+func (e *deliveryError) Unwrap() error { return e.Err }
+
+// deferralError asks for the next attempt to wait at least Delay, such as
+// after a greylisting server told us to come back later.
+type deferralError struct {
+	Err   error
+	Delay time.Duration
+}
+
+func (e *deferralError) Error() string { return e.Err.Error() }
+
+func (e *deferralError) Unwrap() error { return e.Err }
+
+func (e *deferralError) retryDelay() time.Duration { return e.Delay }
+
+// backoff returns an exponentially growing delay for the given attempt with
+// half of it randomised so that retries from many workers spread out.
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+
+	if d > max {
+		d = max
+	}
+
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+
+	return half + rand.N(half)
+}
+
+type deadLetter struct {
+	Message  *message  `json:"message"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+type deadLetterRecord struct {
+	Op     string      `json:"op"`
+	ID     string      `json:"id"`
+	Letter *deadLetter `json:"letter,omitempty"`
+}
+
+// deadLetterStore keeps messages that failed permanently or ran out of
+// attempts until an operator requeues them.
+type deadLetterStore struct {
+	mu      sync.Mutex
+	journal *journal
+	letters map[string]*deadLetter
+}
+
+func openDeadLetterStore(dir string) (*deadLetterStore, error) {
+	s := &deadLetterStore{letters: make(map[string]*deadLetter)}
+
+	j, err := openJournal(filepath.Join(dir, "deadletters.log"), func(line []byte) error {
+		var r deadLetterRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return err
+		}
+
+		switch r.Op {
+		case "put":
+			s.letters[r.ID] = r.Letter
+		case "del":
+			delete(s.letters, r.ID)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]any, 0, len(s.letters))
+	for id, l := range s.letters {
+		records = append(records, deadLetterRecord{Op: "put", ID: id, Letter: l})
+	}
+
+	if err := j.compact(records); err != nil {
+		j.close()
+		return nil, err
+	}
+
+	s.journal = j
+
+	return s, nil
+}
+
+func (s *deadLetterStore) put(msg *message) error {
+	l := &deadLetter{Message: msg, FailedAt: time.Now().UTC()}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.journal.append(deadLetterRecord{Op: "put", ID: msg.ID, Letter: l}); err != nil {
+		return err
+	}
+
+	s.letters[msg.ID] = l
+
+	return nil
+}
+
+func (s *deadLetterStore) get(id string) (*deadLetter, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.letters[id]
+	return l, ok
+}
+
+func (s *deadLetterStore) list() []*deadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letters := make([]*deadLetter, 0, len(s.letters))
+	for _, l := range s.letters {
+		letters = append(letters, l)
+	}
+
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].FailedAt.Before(letters[j].FailedAt)
+	})
+
+	return letters
+}
+
+func (s *deadLetterStore) remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.journal.append(deadLetterRecord{Op: "del", ID: id}); err != nil {
+		return err
+	}
+
+	delete(s.letters, id)
+
+	return nil
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"net/http"
-	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -11,6 +10,7 @@ import (
 func (app *application) routes() http.Handler {
 
 	e := echo.New()
+	e.IPExtractor = ipExtractor(app.trustedProxies)
 
 	DefaultCORSConfig := middleware.CORSConfig{
 		Skipper:      middleware.DefaultSkipper,
@@ -20,9 +20,7 @@ func (app *application) routes() http.Handler {
 
 	config := middleware.RateLimiterConfig{
 		Skipper: middleware.DefaultSkipper,
-		Store: middleware.NewRateLimiterMemoryStoreWithConfig(
-			middleware.RateLimiterMemoryStoreConfig{Rate: 10, Burst: 30, ExpiresIn: 3 * time.Minute},
-		),
+		Store:   &ipRateLimiter{store: app.rateLimitStore, policy: app.ipRateLimit},
 		IdentifierExtractor: func(ctx echo.Context) (string, error) {
 			id := ctx.RealIP()
 			return id, nil
@@ -39,14 +37,46 @@ func (app *application) routes() http.Handler {
 	e.Use(middleware.Recover())
 	e.Use(middleware.RateLimiterWithConfig(config))
 	e.Use(middleware.CORSWithConfig(DefaultCORSConfig))
-	e.Use(middleware.BodyLimit("2K"))
-
-	e.POST("/submit-contact", app.sendContactEmailHandler)
-	e.POST("/signup", app.sendWelcomeEmailHandler)
-	e.POST("/activate", app.sendActivateEmailHandler)
-	e.POST("/resetpwd", app.sendPasswordResetEmailHandler)
-	e.POST("/completedpwdreset", app.sendResetCompletedEmailHandler)
-	
+
+	bodyLimit := middleware.BodyLimit(app.config.limits.body)
+	attachmentLimit := middleware.BodyLimit(app.config.limits.attachments)
+
+	// internal wraps routes meant for our own backend. They are restricted
+	// to the internal allowlist and require a signed request when those are
+	// configured.
+	internal := func(mw ...echo.MiddlewareFunc) []echo.MiddlewareFunc {
+		var chain []echo.MiddlewareFunc
+		if !app.internalIPs.empty() {
+			chain = append(chain, app.FilterIPAddress(app.internalIPs))
+		}
+		chain = append(chain, mw...)
+		if app.config.signing.secret != "" {
+			chain = append(chain, app.verifySignature)
+		}
+		return chain
+	}
+
+	e.GET("/contact-token", app.contactTokenHandler)
+	e.POST("/submit-contact", app.sendContactEmailHandler, bodyLimit)
+	e.POST("/signup", app.sendWelcomeEmailHandler, internal(bodyLimit, app.requireScope(scope("signup")))...)
+	e.POST("/activate", app.sendActivateEmailHandler, internal(bodyLimit, app.requireScope(scope("activate")))...)
+	e.POST("/resetpwd", app.sendPasswordResetEmailHandler, internal(bodyLimit, app.requireScope(scope("resetpwd")))...)
+	e.POST("/completedpwdreset", app.sendResetCompletedEmailHandler, internal(bodyLimit, app.requireScope(scope("completedpwdreset")))...)
+	e.POST("/send/:template", app.sendTemplateEmailHandler, internal(attachmentLimit, app.requireScope(templateScope))...)
+	e.GET("/messages/:id", app.showMessageStatusHandler, internal(app.requireScope(scope("messages")))...)
+	e.POST("/bounces", app.inboundBounceHandler, internal(attachmentLimit, app.requireScope(scope("bounces")))...)
+
+	admin := e.Group("/admin", app.FilterIPAddress(app.adminIPs), bodyLimit, app.requireScope(scope("admin")))
+	admin.GET("/deadletters", app.listDeadLettersHandler)
+	admin.GET("/deadletters/:id", app.showDeadLetterHandler)
+	admin.POST("/deadletters/:id/requeue", app.requeueDeadLetterHandler)
+	admin.GET("/addresses/:address", app.showAddressHandler)
+	admin.DELETE("/addresses/:address", app.resetAddressHandler)
+	admin.GET("/suppressions", app.listSuppressionsHandler)
+	admin.POST("/suppressions", app.addSuppressionHandler)
+	admin.DELETE("/suppressions/:value", app.removeSuppressionHandler)
+	admin.GET("/webhooks/deliveries", app.listWebhookDeliveriesHandler)
+
 	return e
 
 }
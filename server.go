@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"os"
@@ -49,7 +50,12 @@ func (app *application) serve() error {
 			slog.String("addr", srv.Addr),
 		)
 
+		app.queue.close()
 		app.wg.Wait()
+
+		if c, ok := app.transport.(io.Closer); ok {
+			c.Close()
+		}
 		shutdownError <- nil
 
 	}()
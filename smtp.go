@@ -0,0 +1,386 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"sync"
+	"time"
+)
+
+const smtpDialTimeout = 10 * time.Second
+
+var errAuthFailed = errors.New("AUTH failed")
+
+const (
+	smtpTLSNone          = "none"
+	smtpTLSOpportunistic = "opportunistic"
+	smtpTLSRequired      = "starttls-required"
+	smtpTLSImplicit      = "implicit"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// smtpTLSConfig builds the TLS settings for a relay. The server name
+// defaults to the relay host and the CA bundle to the system roots.
+func smtpTLSConfig(rc relayConfig) (*tls.Config, error) {
+	switch rc.TLS {
+	case smtpTLSNone, smtpTLSOpportunistic, smtpTLSRequired, smtpTLSImplicit:
+	default:
+		return nil, fmt.Errorf("unknown tls mode %q", rc.TLS)
+	}
+
+	minVersion, ok := tlsVersions[rc.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown tls version %q", rc.TLSMinVersion)
+	}
+
+	tlsCfg := &tls.Config{
+		ServerName: rc.Host,
+		MinVersion: minVersion,
+	}
+
+	if rc.ServerName != "" {
+		tlsCfg.ServerName = rc.ServerName
+	}
+
+	if rc.CAFile != "" {
+		pem, err := os.ReadFile(rc.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", rc.CAFile)
+		}
+	}
+
+	if rc.CertFile != "" || rc.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(rc.CertFile, rc.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsCfg, nil
+}
+
+type smtpConn struct {
+	client   *smtp.Client
+	conn     net.Conn
+	sent     int
+	lastUsed time.Time
+}
+
+// deadline bounds the next phase of the session. It applies through the
+// TLS layer, which shares the underlying connection.
+func (c *smtpConn) deadline(d time.Duration) {
+	c.conn.SetDeadline(time.Now().Add(d))
+}
+
+// isTimeout reports whether err is a connection deadline running out.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// smtpTransport delivers through one relay. It keeps authenticated
+// connections open between messages, resetting the session with RSET, and
+// retires a connection after maxMessages messages or idleTimeout of disuse.
+// Each phase of a session must finish within timeout. At most cap(slots)
+// messages are in flight at once.
+type smtpTransport struct {
+	host string
+	port string
+	auth smtp.Auth
+
+	tlsMode   string
+	tlsConfig *tls.Config
+
+	maxMessages int
+	idleTimeout time.Duration
+	timeout     time.Duration
+	slots       chan struct{}
+
+	mu     sync.Mutex
+	idle   []*smtpConn
+	closed bool
+	stop   chan struct{}
+}
+
+func newSMTPTransport(rc relayConfig, cfg config) (*smtpTransport, error) {
+	tlsCfg, err := smtpTLSConfig(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := smtpAuth(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &smtpTransport{
+		host:        rc.Host,
+		port:        rc.Port,
+		auth:        auth,
+		tlsMode:     rc.TLS,
+		tlsConfig:   tlsCfg,
+		maxMessages: cfg.pool.maxMessages,
+		idleTimeout: cfg.pool.idleTimeout,
+		timeout:     cfg.pool.timeout,
+		slots:       make(chan struct{}, cfg.pool.size),
+		stop:        make(chan struct{}),
+	}
+
+	go t.reap()
+
+	return t, nil
+}
+
+func (t *smtpTransport) Send(from string, to []string, msg []byte) error {
+	t.slots <- struct{}{}
+	defer func() { <-t.slots }()
+
+	for {
+		conn, reused, err := t.get()
+		if err != nil {
+			return err
+		}
+
+		conn.deadline(t.timeout)
+
+		err = sendMessage(conn.client, from, to, msg)
+		if err == nil {
+			t.put(conn)
+			return nil
+		}
+
+		// The relay answered, so the session is still usable after a reset.
+		var tpErr *textproto.Error
+		if errors.As(err, &tpErr) {
+			t.put(conn)
+			return err
+		}
+
+		conn.client.Close()
+
+		// A relay that stops answering is failing; let the pool move on.
+		if isTimeout(err) {
+			return &sessionError{Err: fmt.Errorf("%s timed out: %w", net.JoinHostPort(t.host, t.port), err)}
+		}
+
+		// Relays drop connections that sit idle; a stale pooled connection
+		// should not cost the message an attempt.
+		if !reused {
+			return err
+		}
+	}
+}
+
+func sendMessage(c *smtp.Client, from string, to []string, msg []byte) error {
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+func (t *smtpTransport) get() (*smtpConn, bool, error) {
+	t.mu.Lock()
+	for len(t.idle) > 0 {
+		conn := t.idle[len(t.idle)-1]
+		t.idle = t.idle[:len(t.idle)-1]
+
+		if time.Since(conn.lastUsed) < t.idleTimeout {
+			t.mu.Unlock()
+			return conn, true, nil
+		}
+
+		conn.client.Close()
+	}
+	t.mu.Unlock()
+
+	conn, err := t.dial()
+	if err != nil {
+		return nil, false, err
+	}
+
+	return conn, false, nil
+}
+
+// dial opens an authenticated session with the relay. Every failure is a
+// *sessionError, so that the pool moves on to the next relay.
+func (t *smtpTransport) dial() (*smtpConn, error) {
+	conn, err := t.connect()
+
+	// An OAuth2 token can be revoked before it expires. net/smtp ends the
+	// session when AUTH fails, so dial once more with a fresh token.
+	var tpErr *textproto.Error
+	if xa, ok := t.auth.(*xoauth2Auth); ok && errors.Is(err, errAuthFailed) && errors.As(err, &tpErr) && xa.tokens.Invalidate() {
+		conn, err = t.connect()
+	}
+
+	if err != nil {
+		return nil, &sessionError{Err: err}
+	}
+	return conn, nil
+}
+
+func (t *smtpTransport) connect() (*smtpConn, error) {
+	addr := net.JoinHostPort(t.host, t.port)
+	dialer := &net.Dialer{Timeout: smtpDialTimeout}
+
+	var conn net.Conn
+	var err error
+	if t.tlsMode == smtpTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, t.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The greeting, EHLO, STARTTLS and AUTH share one deadline.
+	conn.SetDeadline(time.Now().Add(t.timeout))
+
+	client, err := smtp.NewClient(conn, t.host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if t.tlsMode == smtpTLSOpportunistic || t.tlsMode == smtpTLSRequired {
+		ok, _ := client.Extension("STARTTLS")
+		if !ok && t.tlsMode == smtpTLSRequired {
+			client.Close()
+			return nil, fmt.Errorf("%s does not offer STARTTLS, which is required", addr)
+		}
+
+		if ok {
+			if err := client.StartTLS(t.tlsConfig); err != nil {
+				client.Close()
+				return nil, fmt.Errorf("STARTTLS with %s failed: %v", addr, err)
+			}
+		}
+	}
+
+	if t.auth != nil {
+		if err := client.Auth(t.auth); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("%s: %w: %w", addr, errAuthFailed, err)
+		}
+	}
+
+	return &smtpConn{client: client, conn: conn}, nil
+}
+
+// put resets a connection and returns it to the pool, or closes it once it
+// has carried maxMessages messages.
+func (t *smtpTransport) put(conn *smtpConn) {
+	conn.sent++
+	conn.deadline(t.timeout)
+
+	if conn.sent >= t.maxMessages {
+		conn.client.Quit()
+		return
+	}
+
+	if err := conn.client.Reset(); err != nil {
+		conn.client.Close()
+		return
+	}
+
+	conn.lastUsed = time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		conn.client.Quit()
+		return
+	}
+
+	t.idle = append(t.idle, conn)
+}
+
+// reap closes connections that have been idle for longer than idleTimeout.
+func (t *smtpTransport) reap() {
+	ticker := time.NewTicker(t.idleTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+
+		var expired []*smtpConn
+
+		t.mu.Lock()
+		kept := t.idle[:0]
+		for _, conn := range t.idle {
+			if time.Since(conn.lastUsed) >= t.idleTimeout {
+				expired = append(expired, conn)
+				continue
+			}
+			kept = append(kept, conn)
+		}
+		t.idle = kept
+		t.mu.Unlock()
+
+		for _, conn := range expired {
+			conn.deadline(t.timeout)
+			conn.client.Quit()
+		}
+	}
+}
+
+// Close ends every pooled session.
+func (t *smtpTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil
+	}
+
+	t.closed = true
+	close(t.stop)
+
+	for _, conn := range t.idle {
+		conn.deadline(t.timeout)
+		conn.client.Quit()
+	}
+	t.idle = nil
+
+	return nil
+}
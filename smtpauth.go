@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	smtpAuthNone    = "none"
+	smtpAuthPlain   = "plain"
+	smtpAuthLogin   = "login"
+	smtpAuthCRAMMD5 = "cram-md5"
+	smtpAuthXOAuth2 = "xoauth2"
+)
+
+// smtpAuth returns the authentication a relay uses, or nil for none.
+func smtpAuth(rc relayConfig) (smtp.Auth, error) {
+	switch rc.Auth {
+	case smtpAuthNone:
+		return nil, nil
+	case smtpAuthPlain:
+		return smtp.PlainAuth("", rc.User, rc.Password, rc.Host), nil
+	case smtpAuthLogin:
+		return &loginAuth{user: rc.User, password: rc.Password, host: rc.Host}, nil
+	case smtpAuthCRAMMD5:
+		return smtp.CRAMMD5Auth(rc.User, rc.Password), nil
+	case smtpAuthXOAuth2:
+		var tokens tokenSource = staticToken(rc.Password)
+		if rc.OAuthTokenURL != "" {
+			tokens = &refreshTokenSource{
+				url:          rc.OAuthTokenURL,
+				clientID:     rc.OAuthClientID,
+				clientSecret: rc.OAuthClientSecret,
+				refreshToken: rc.OAuthRefreshToken,
+				client:       &http.Client{Timeout: 10 * time.Second},
+			}
+		}
+		return &xoauth2Auth{user: rc.User, host: rc.Host, tokens: tokens}, nil
+	default:
+		return nil, fmt.Errorf("unknown auth mechanism %q", rc.Auth)
+	}
+}
+
+// requireTLS mirrors smtp.PlainAuth: credentials only go over TLS, except
+// to a relay on the local machine.
+func requireTLS(server *smtp.ServerInfo, host string) error {
+	if server.Name != host {
+		return errors.New("wrong host name")
+	}
+
+	if server.TLS || host == "localhost" {
+		return nil
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+
+	return errors.New("unencrypted connection")
+}
+
+// loginAuth implements the LOGIN mechanism still expected by some
+// Office 365 and Exchange relays.
+type loginAuth struct {
+	user     string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := requireTLS(server, a.host); err != nil {
+		return "", nil, err
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	prompt := strings.ToLower(strings.TrimSpace(string(fromServer)))
+	switch {
+	case strings.HasPrefix(prompt, "user"):
+		return []byte(a.user), nil
+	case strings.HasPrefix(prompt, "pass"):
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected LOGIN prompt %q", fromServer)
+	}
+}
+
+// tokenSource supplies OAuth2 access tokens for XOAUTH2. Implementations
+// refresh the token themselves when it expires.
+type tokenSource interface {
+	Token() (string, error)
+
+	// Invalidate drops a token the server rejected and reports whether the
+	// next call to Token can return a different one.
+	Invalidate() bool
+}
+
+// staticToken is an access token managed outside the mailer.
+type staticToken string
+
+func (t staticToken) Token() (string, error) {
+	if t == "" {
+		return "", errors.New("no access token configured")
+	}
+	return string(t), nil
+}
+
+func (t staticToken) Invalidate() bool {
+	return false
+}
+
+// refreshTokenSource trades a refresh token for access tokens at an OAuth2
+// token endpoint and caches each one until shortly before it expires.
+type refreshTokenSource struct {
+	url          string
+	clientID     string
+	clientSecret string
+	refreshToken string
+	client       *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (s *refreshTokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Until(s.expiry) > time.Minute {
+		return s.token, nil
+	}
+
+	resp, err := s.client.PostForm(s.url, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {s.refreshToken},
+		"client_id":     {s.clientID},
+		"client_secret": {s.clientSecret},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to refresh access token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return "", fmt.Errorf("failed to refresh access token: %s %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+
+	s.token = body.AccessToken
+	s.expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	if body.ExpiresIn == 0 {
+		s.expiry = time.Now().Add(time.Hour)
+	}
+
+	return s.token, nil
+}
+
+func (s *refreshTokenSource) Invalidate() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.token = ""
+
+	return true
+}
+
+// xoauth2Auth implements the XOAUTH2 mechanism used by Gmail and
+// Office 365.
+type xoauth2Auth struct {
+	user   string
+	host   string
+	tokens tokenSource
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := requireTLS(server, a.host); err != nil {
+		return "", nil, err
+	}
+
+	token, err := a.tokens.Token()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return "XOAUTH2", []byte("user=" + a.user + "\x01auth=Bearer " + token + "\x01\x01"), nil
+}
+
+// Next answers the JSON error challenge sent after a rejected token with an
+// empty response, after which the server reports the failure.
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	spamActionDrop   = "drop"
+	spamActionFlag   = "flag"
+	spamActionReject = "reject"
+)
+
+// captchaVerifier checks a captcha response submitted with the contact form.
+type captchaVerifier interface {
+	Verify(token, remoteIP string) (bool, error)
+}
+
+// stubCaptcha accepts exactly one token. It stands in for a real provider in
+// tests and local development.
+type stubCaptcha struct {
+	token string
+}
+
+func (s stubCaptcha) Verify(token, remoteIP string) (bool, error) {
+	return token != "" && token == s.token, nil
+}
+
+func newCaptchaVerifier(provider, stubToken string) (captchaVerifier, error) {
+	switch provider {
+	case "", "none":
+		return nil, nil
+	case "stub":
+		return stubCaptcha{token: stubToken}, nil
+	default:
+		return nil, fmt.Errorf("unknown captcha provider %q", provider)
+	}
+}
+
+var linkPattern = regexp.MustCompile(`(?i)https?://|www\.`)
+
+// spamFilter screens contact form submissions. Every check that trips adds
+// a reason; what happens to a submission with reasons is decided by action.
+type spamFilter struct {
+	action    string
+	secret    []byte
+	minSubmit time.Duration
+	maxAge    time.Duration
+	captcha   captchaVerifier
+	keywords  []string
+	maxScore  int
+}
+
+func newSpamFilter(cfg config) (*spamFilter, error) {
+	switch cfg.spam.action {
+	case spamActionDrop, spamActionFlag, spamActionReject:
+	default:
+		return nil, fmt.Errorf("unknown spam action %q", cfg.spam.action)
+	}
+
+	secret := []byte(cfg.spam.tokenSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	}
+
+	captcha, err := newCaptchaVerifier(cfg.spam.captcha, cfg.spam.captchaStubToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var keywords []string
+	for _, k := range strings.Split(cfg.spam.keywords, ",") {
+		if k = strings.ToLower(strings.TrimSpace(k)); k != "" {
+			keywords = append(keywords, k)
+		}
+	}
+
+	return &spamFilter{
+		action:    cfg.spam.action,
+		secret:    secret,
+		minSubmit: cfg.spam.minSubmit,
+		maxAge:    24 * time.Hour,
+		captcha:   captcha,
+		keywords:  keywords,
+		maxScore:  cfg.spam.maxScore,
+	}, nil
+}
+
+// issueToken returns a form token recording when the form was served.
+func (f *spamFilter) issueToken(now time.Time) string {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	return ts + "." + f.sign(ts)
+}
+
+func (f *spamFilter) sign(ts string) string {
+	mac := hmac.New(sha256.New, f.secret)
+	mac.Write([]byte(ts))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (f *spamFilter) checkToken(token string, now time.Time) string {
+	ts, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(f.sign(ts))) {
+		return "invalid form token"
+	}
+
+	issued, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "invalid form token"
+	}
+
+	age := now.Sub(time.Unix(issued, 0))
+	if age < f.minSubmit {
+		return "form submitted too quickly"
+	}
+	if age > f.maxAge {
+		return "form token expired"
+	}
+
+	return ""
+}
+
+// score rates the message text: each link counts 2 and each keyword hit 3.
+func (f *spamFilter) score(form ContactForm) int {
+	text := strings.ToLower(form.Message + " " + form.Service)
+
+	score := 2 * len(linkPattern.FindAllString(text, -1))
+	for _, k := range f.keywords {
+		score += 3 * strings.Count(text, k)
+	}
+
+	return score
+}
+
+func (f *spamFilter) check(form ContactForm, remoteIP string, now time.Time) ([]string, error) {
+	var reasons []string
+
+	if form.Website != "" {
+		reasons = append(reasons, "honeypot field filled in")
+	}
+
+	if f.minSubmit > 0 {
+		if reason := f.checkToken(form.FormToken, now); reason != "" {
+			reasons = append(reasons, reason)
+		}
+	}
+
+	if f.captcha != nil {
+		ok, err := f.captcha.Verify(form.CaptchaToken, remoteIP)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			reasons = append(reasons, "captcha failed")
+		}
+	}
+
+	if f.maxScore > 0 {
+		if score := f.score(form); score > f.maxScore {
+			reasons = append(reasons, fmt.Sprintf("content score %d above %d", score, f.maxScore))
+		}
+	}
+
+	return reasons, nil
+}
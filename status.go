@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	statusQueued   = "queued"
+	statusSending  = "sending"
+	statusSent     = "sent"
+	statusDeferred = "deferred"
+	statusFailed   = "failed"
+	statusBounced  = "bounced"
+)
+
+type statusEvent struct {
+	Status string    `json:"status"`
+	At     time.Time `json:"at"`
+}
+
+type messageStatus struct {
+	ID           string        `json:"id"`
+	Recipients   []string      `json:"recipients,omitempty"`
+	Status       string        `json:"status"`
+	Attempts     int           `json:"attempts"`
+	LastResponse string        `json:"last_response,omitempty"`
+	CreatedAt    time.Time     `json:"created_at"`
+	UpdatedAt    time.Time     `json:"updated_at"`
+	NextAttempt  *time.Time    `json:"next_attempt,omitempty"`
+	History      []statusEvent `json:"history"`
+}
+
+// statusStore records the lifecycle of every accepted message. Entries older
+// than the retention period are dropped when the store is opened.
+type statusStore struct {
+	mu       sync.Mutex
+	journal  *journal
+	statuses map[string]*messageStatus
+}
+
+func openStatusStore(dir string, retention time.Duration) (*statusStore, error) {
+	s := &statusStore{statuses: make(map[string]*messageStatus)}
+
+	j, err := openJournal(filepath.Join(dir, "status.log"), func(line []byte) error {
+		var st messageStatus
+		if err := json.Unmarshal(line, &st); err != nil {
+			return err
+		}
+
+		s.statuses[st.ID] = &st
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-retention)
+	records := make([]any, 0, len(s.statuses))
+	for id, st := range s.statuses {
+		if st.UpdatedAt.Before(cutoff) {
+			delete(s.statuses, id)
+			continue
+		}
+		records = append(records, st)
+	}
+
+	if err := j.compact(records); err != nil {
+		j.close()
+		return nil, err
+	}
+
+	s.journal = j
+
+	return s, nil
+}
+
+func (s *statusStore) get(id string) (messageStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.statuses[id]
+	if !ok {
+		return messageStatus{}, false
+	}
+
+	cp := *st
+	cp.History = append([]statusEvent(nil), st.History...)
+
+	return cp, true
+}
+
+func (s *statusStore) update(msg *message, status, response string) error {
+	now := time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.statuses[msg.ID]
+	if !ok {
+		st = &messageStatus{ID: msg.ID, Recipients: msg.To, CreatedAt: msg.CreatedAt}
+	}
+
+	updated := *st
+	updated.Status = status
+	updated.Attempts = msg.Attempts
+	updated.UpdatedAt = now
+	updated.NextAttempt = nil
+	updated.History = append(append([]statusEvent(nil), st.History...), statusEvent{Status: status, At: now})
+
+	if response != "" {
+		updated.LastResponse = response
+	}
+
+	if status == statusDeferred {
+		next := msg.NextAttempt
+		updated.NextAttempt = &next
+	}
+
+	if err := s.journal.append(&updated); err != nil {
+		return err
+	}
+
+	s.statuses[msg.ID] = &updated
+
+	return nil
+}
+
+// mark moves a message the store already knows to a new status, such as
+// when a bounce arrives after delivery. It reports whether the message was
+// found.
+func (s *statusStore) mark(id, status, response string) (bool, error) {
+	now := time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.statuses[id]
+	if !ok {
+		return false, nil
+	}
+
+	updated := *st
+	updated.Status = status
+	updated.UpdatedAt = now
+	updated.NextAttempt = nil
+	updated.History = append(append([]statusEvent(nil), st.History...), statusEvent{Status: status, At: now})
+
+	if response != "" {
+		updated.LastResponse = response
+	}
+
+	if err := s.journal.append(&updated); err != nil {
+		return false, err
+	}
+
+	s.statuses[id] = &updated
+
+	return true, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	suppressAddress = "address"
+	suppressDomain  = "domain"
+
+	reasonBounce = "bounce"
+)
+
+// suppression keeps mail from being sent to an address, or to every address
+// at a domain, until it expires. Entries without ExpiresAt never expire.
+type suppression struct {
+	Value     string     `json:"value"`
+	Type      string     `json:"type"`
+	Reason    string     `json:"reason"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (s suppression) expired(now time.Time) bool {
+	return s.ExpiresAt != nil && !now.Before(*s.ExpiresAt)
+}
+
+type suppressionRecord struct {
+	Op    string       `json:"op"`
+	Value string       `json:"value"`
+	Entry *suppression `json:"entry,omitempty"`
+}
+
+// suppressedRecipient is a recipient together with the entry suppressing
+// it.
+type suppressedRecipient struct {
+	Recipient string `json:"recipient"`
+	suppression
+}
+
+// suppressedError is returned by check when recipients are suppressed.
+type suppressedError struct {
+	recipients []suppressedRecipient
+}
+
+func (e *suppressedError) Error() string {
+	return fmt.Sprintf("recipient suppressed: %s", strings.Join(e.addresses(), ", "))
+}
+
+func (e *suppressedError) addresses() []string {
+	values := make([]string, 0, len(e.recipients))
+	for _, r := range e.recipients {
+		values = append(values, r.Recipient)
+	}
+	return values
+}
+
+// suppressionList is the persistent set of suppressed addresses and
+// domains. Expired entries are ignored and dropped when the list is opened.
+type suppressionList struct {
+	mu      sync.Mutex
+	journal *journal
+	entries map[string]*suppression
+}
+
+func openSuppressionList(dir string) (*suppressionList, error) {
+	l := &suppressionList{entries: make(map[string]*suppression)}
+
+	j, err := openJournal(filepath.Join(dir, "suppressions.log"), func(line []byte) error {
+		var r suppressionRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return err
+		}
+
+		switch r.Op {
+		case "put":
+			l.entries[r.Value] = r.Entry
+		case "remove":
+			delete(l.entries, r.Value)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	records := make([]any, 0, len(l.entries))
+	for value, s := range l.entries {
+		if s.expired(now) {
+			delete(l.entries, value)
+			continue
+		}
+		records = append(records, suppressionRecord{Op: "put", Value: value, Entry: s})
+	}
+
+	if err := j.compact(records); err != nil {
+		j.close()
+		return nil, err
+	}
+
+	l.journal = j
+
+	return l, nil
+}
+
+// newSuppression builds an entry for value, which is an address when it
+// contains an @ and a domain otherwise.
+func newSuppression(value, reason string, expiresAt *time.Time) suppression {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	kind := suppressDomain
+	if strings.Contains(value, "@") {
+		kind = suppressAddress
+	}
+
+	return suppression{
+		Value:     value,
+		Type:      kind,
+		Reason:    reason,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+}
+
+// add stores s, replacing any entry for the same value.
+func (l *suppressionList) add(s suppression) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.journal.append(suppressionRecord{Op: "put", Value: s.Value, Entry: &s}); err != nil {
+		return err
+	}
+
+	l.entries[s.Value] = &s
+
+	return nil
+}
+
+func (l *suppressionList) remove(value string) (bool, error) {
+	value = strings.ToLower(value)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.entries[value]; !ok {
+		return false, nil
+	}
+
+	if err := l.journal.append(suppressionRecord{Op: "remove", Value: value}); err != nil {
+		return false, err
+	}
+
+	delete(l.entries, value)
+
+	return true, nil
+}
+
+// lookup returns the entry suppressing addr, checking the address before
+// its domain.
+func (l *suppressionList) lookup(addr string, now time.Time) (suppression, bool) {
+	addr = strings.ToLower(addr)
+	_, domain, _ := strings.Cut(addr, "@")
+
+	for _, value := range []string{addr, domain} {
+		if s, ok := l.entries[value]; ok && !s.expired(now) {
+			return *s, true
+		}
+	}
+
+	return suppression{}, false
+}
+
+// get returns the unexpired entry suppressing addr, if any.
+func (l *suppressionList) get(addr string) (suppression, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.lookup(addr, time.Now())
+}
+
+// check returns a *suppressedError naming every suppressed recipient.
+func (l *suppressionList) check(recipients []string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	var found []suppressedRecipient
+	for _, r := range recipients {
+		if s, ok := l.lookup(r, now); ok {
+			found = append(found, suppressedRecipient{Recipient: r, suppression: s})
+		}
+	}
+
+	if len(found) == 0 {
+		return nil
+	}
+
+	return &suppressedError{recipients: found}
+}
+
+// list returns the unexpired entries, ordered by value.
+func (l *suppressionList) list() []suppression {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	entries := make([]suppression, 0, len(l.entries))
+	for _, s := range l.entries {
+		if !s.expired(now) {
+			entries = append(entries, *s)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Value < entries[j].Value })
+
+	return entries
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var blankLines = regexp.MustCompile(`\n{3,}`)
+
+// htmlToText derives a plain-text body from rendered HTML. Links are kept as
+// numbered footnotes listed after the text.
+func htmlToText(src string) string {
+	var (
+		b     strings.Builder
+		links []string
+		href  string
+		skip  int
+	)
+
+	z := html.NewTokenizer(strings.NewReader(src))
+
+	for {
+		tt := z.Next()
+
+		switch tt {
+		case html.ErrorToken:
+			if z.Err() != io.EOF {
+				return strings.TrimSpace(src)
+			}
+
+			text := strings.TrimSpace(tidyLines(b.String()))
+
+			if len(links) > 0 {
+				text += "\n\nLinks:\n"
+				for i, l := range links {
+					text += fmt.Sprintf("[%d] %s\n", i+1, l)
+				}
+			}
+
+			return strings.TrimRight(text, "\n") + "\n"
+
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+			b.WriteString(collapseSpace(string(z.Text())))
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+
+			switch tok.DataAtom {
+			case atom.Head, atom.Style, atom.Script, atom.Title:
+				if tt == html.StartTagToken {
+					skip++
+				}
+			case atom.Br:
+				b.WriteString("\n")
+			case atom.Li:
+				b.WriteString("\n- ")
+			case atom.A:
+				href = ""
+				for _, attr := range tok.Attr {
+					if attr.Key == "href" {
+						href = strings.TrimSpace(attr.Val)
+					}
+				}
+			default:
+				if isBlock(tok.DataAtom) {
+					b.WriteString("\n\n")
+				}
+			}
+
+		case html.EndTagToken:
+			tok := z.Token()
+
+			switch tok.DataAtom {
+			case atom.Head, atom.Style, atom.Script, atom.Title:
+				if skip > 0 {
+					skip--
+				}
+			case atom.A:
+				if href != "" && !strings.HasPrefix(href, "#") {
+					links = append(links, strings.TrimPrefix(href, "mailto:"))
+					fmt.Fprintf(&b, " [%d]", len(links))
+				}
+				href = ""
+			default:
+				if isBlock(tok.DataAtom) {
+					b.WriteString("\n\n")
+				}
+			}
+		}
+	}
+}
+
+func isBlock(a atom.Atom) bool {
+	switch a {
+	case atom.P, atom.Div, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6,
+		atom.Table, atom.Tr, atom.Ul, atom.Ol, atom.Section, atom.Header, atom.Footer,
+		atom.Blockquote, atom.Hr:
+		return true
+	}
+	return false
+}
+
+func collapseSpace(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		if s != "" {
+			return " "
+		}
+		return ""
+	}
+
+	out := strings.Join(fields, " ")
+	if strings.TrimLeft(s, " \t\r\n") != s {
+		out = " " + out
+	}
+	if strings.TrimRight(s, " \t\r\n") != s {
+		out += " "
+	}
+
+	return out
+}
+
+func tidyLines(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimSpace(l)
+	}
+
+	return blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+}
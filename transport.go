@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Transport hands a fully built message to something that delivers it.
+type Transport interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+func newTransport(cfg config) (Transport, error) {
+	switch cfg.mail.transport {
+	case "", "smtp":
+		return newRelayRouter(cfg)
+	case "mx":
+		return newMXTransport(cfg)
+	case "file":
+		return newFileTransport(cfg.mail.dir)
+	case "memory":
+		return &memoryTransport{}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail transport %q", cfg.mail.transport)
+	}
+}
+
+// fileTransport writes every message into a maildir so it can be opened by
+// a local mail client instead of being delivered.
+type fileTransport struct {
+	dir string
+}
+
+func newFileTransport(dir string) (*fileTransport, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("file transport requires a mail directory")
+	}
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create maildir: %v", err)
+		}
+	}
+
+	return &fileTransport{dir: dir}, nil
+}
+
+func (t *fileTransport) Send(from string, to []string, msg []byte) error {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d.%s.mailer", time.Now().UnixNano(), hex.EncodeToString(b))
+
+	tmp := filepath.Join(t.dir, "tmp", name)
+	if err := os.WriteFile(tmp, msg, 0o644); err != nil {
+		return fmt.Errorf("failed to write message: %v", err)
+	}
+
+	return os.Rename(tmp, filepath.Join(t.dir, "new", name))
+}
+
+type sentMessage struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// memoryTransport records messages instead of sending them.
+type memoryTransport struct {
+	mu       sync.Mutex
+	messages []sentMessage
+}
+
+func (t *memoryTransport) Send(from string, to []string, msg []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.messages = append(t.messages, sentMessage{
+		From: from,
+		To:   append([]string(nil), to...),
+		Data: append([]byte(nil), msg...),
+	})
+
+	return nil
+}
+
+func (t *memoryTransport) Messages() []sentMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]sentMessage(nil), t.messages...)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	eventSent     = "sent"
+	eventDeferred = "deferred"
+	eventBounced  = "bounced"
+	eventFailed   = "failed"
+
+	webhookPending   = "pending"
+	webhookDelivered = "delivered"
+	webhookFailed    = "failed"
+
+	headerEvent = "X-Mailer-Event"
+)
+
+var webhookEvents = []string{eventSent, eventDeferred, eventBounced, eventFailed}
+
+// webhookConfig is one endpoint from the webhooks section of the config
+// file. An endpoint without events receives all of them.
+type webhookConfig struct {
+	Name   string   `yaml:"name"`
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"`
+	Events []string `yaml:"events"`
+}
+
+func (wc webhookConfig) wants(event string) bool {
+	return len(wc.Events) == 0 || slices.Contains(wc.Events, event)
+}
+
+// webhookEvent is the payload posted to endpoints.
+type webhookEvent struct {
+	ID          string     `json:"id"`
+	Event       string     `json:"event"`
+	MessageID   string     `json:"message_id,omitempty"`
+	Template    string     `json:"template,omitempty"`
+	Recipients  []string   `json:"recipients"`
+	Attempts    int        `json:"attempts,omitempty"`
+	Response    string     `json:"response,omitempty"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+	At          time.Time  `json:"at"`
+}
+
+// webhookDelivery is one event on its way to one endpoint. Every attempt is
+// journaled, which makes the journal the delivery log.
+type webhookDelivery struct {
+	ID          string          `json:"id"`
+	Endpoint    string          `json:"endpoint"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	State       string          `json:"state"`
+	Attempts    int             `json:"attempts"`
+	LastStatus  int             `json:"last_status,omitempty"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	NextAttempt *time.Time      `json:"next_attempt,omitempty"`
+}
+
+// webhookDispatcher posts events to the configured endpoints, signed like
+// internal requests, and retries failures with backoff. Pending deliveries
+// are resumed when the dispatcher is reopened, so an event may arrive more
+// than once; receivers can use its id to tell.
+type webhookDispatcher struct {
+	mu         sync.Mutex
+	journal    *journal
+	deliveries map[string]*webhookDelivery
+	endpoints  map[string]webhookConfig
+	client     *http.Client
+
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+}
+
+func openWebhookDispatcher(cfg config) (*webhookDispatcher, error) {
+	d := &webhookDispatcher{
+		deliveries:  make(map[string]*webhookDelivery),
+		endpoints:   make(map[string]webhookConfig),
+		client:      &http.Client{Timeout: cfg.webhook.timeout},
+		maxAttempts: cfg.webhook.maxAttempts,
+		baseDelay:   cfg.webhook.baseDelay,
+		maxDelay:    cfg.webhook.maxDelay,
+	}
+
+	for _, wc := range cfg.webhooks {
+		d.endpoints[wc.Name] = wc
+	}
+
+	j, err := openJournal(filepath.Join(cfg.queue.dir, "webhooks.log"), func(line []byte) error {
+		var wd webhookDelivery
+		if err := json.Unmarshal(line, &wd); err != nil {
+			return err
+		}
+
+		d.deliveries[wd.ID] = &wd
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-cfg.webhook.retention)
+	records := make([]any, 0, len(d.deliveries))
+	for id, wd := range d.deliveries {
+		if wd.State != webhookPending && wd.UpdatedAt.Before(cutoff) {
+			delete(d.deliveries, id)
+			continue
+		}
+		records = append(records, wd)
+	}
+
+	if err := j.compact(records); err != nil {
+		j.close()
+		return nil, err
+	}
+
+	d.journal = j
+
+	return d, nil
+}
+
+// resume restarts the pending deliveries found in the journal. Deliveries to
+// endpoints that are no longer configured are marked failed.
+func (d *webhookDispatcher) resume() {
+	d.mu.Lock()
+	var pending []webhookDelivery
+	for _, wd := range d.deliveries {
+		if wd.State == webhookPending {
+			pending = append(pending, *wd)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, wd := range pending {
+		wc, ok := d.endpoints[wd.Endpoint]
+		if !ok {
+			wd.State = webhookFailed
+			wd.LastError = "endpoint no longer configured"
+			wd.NextAttempt = nil
+			d.record(&wd)
+			continue
+		}
+
+		go d.run(wc, wd)
+	}
+}
+
+// dispatch queues ev for every endpoint subscribed to it.
+func (d *webhookDispatcher) dispatch(ev webhookEvent) {
+	for _, wc := range d.endpoints {
+		if !wc.wants(ev.Event) {
+			continue
+		}
+
+		ev.ID = newMessageID()
+
+		payload, err := json.Marshal(ev)
+		if err != nil {
+			slog.Error("failed to encode webhook event", "event", ev.Event, "error", err)
+			return
+		}
+
+		now := time.Now().UTC()
+		wd := webhookDelivery{
+			ID:        ev.ID,
+			Endpoint:  wc.Name,
+			Event:     ev.Event,
+			Payload:   payload,
+			State:     webhookPending,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+
+		d.record(&wd)
+
+		go d.run(wc, wd)
+	}
+}
+
+// run attempts wd until it is delivered or runs out of attempts.
+func (d *webhookDispatcher) run(wc webhookConfig, wd webhookDelivery) {
+	if wd.NextAttempt != nil {
+		time.Sleep(time.Until(*wd.NextAttempt))
+	}
+
+	for {
+		wd.Attempts++
+		wd.LastStatus, wd.LastError = d.post(wc, wd)
+		wd.UpdatedAt = time.Now().UTC()
+		wd.NextAttempt = nil
+
+		switch {
+		case wd.LastError == "":
+			wd.State = webhookDelivered
+		case wd.Attempts >= d.maxAttempts:
+			wd.State = webhookFailed
+			slog.Error("webhook delivery failed", "id", wd.ID, "endpoint", wd.Endpoint, "event", wd.Event, "attempts", wd.Attempts, "error", wd.LastError)
+		default:
+			next := wd.UpdatedAt.Add(backoff(wd.Attempts, d.baseDelay, d.maxDelay))
+			wd.NextAttempt = &next
+		}
+
+		d.record(&wd)
+
+		if wd.NextAttempt == nil {
+			return
+		}
+
+		time.Sleep(time.Until(*wd.NextAttempt))
+	}
+}
+
+// post sends one attempt and returns the response status and, unless the
+// endpoint answered 2xx, what went wrong.
+func (d *webhookDispatcher) post(wc webhookConfig, wd webhookDelivery) (int, string) {
+	req, err := http.NewRequest(http.MethodPost, wc.URL, bytes.NewReader(wd.Payload))
+	if err != nil {
+		return 0, err.Error()
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerEvent, wd.Event)
+	req.Header.Set(headerTimestamp, timestamp)
+	req.Header.Set(headerNonce, wd.ID)
+	if wc.Secret != "" {
+		req.Header.Set(headerSignature, "sha256="+signRequest([]byte(wc.Secret), timestamp, wd.ID, wd.Payload))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Sprintf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	return resp.StatusCode, ""
+}
+
+func (d *webhookDispatcher) record(wd *webhookDelivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.journal.append(wd); err != nil {
+		slog.Error("failed to record webhook delivery", "id", wd.ID, "error", err)
+	}
+
+	cp := *wd
+	d.deliveries[wd.ID] = &cp
+}
+
+// list returns the delivery log, newest first, optionally only deliveries
+// in the given state.
+func (d *webhookDispatcher) list(state string) []webhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	deliveries := make([]webhookDelivery, 0, len(d.deliveries))
+	for _, wd := range d.deliveries {
+		if state == "" || wd.State == state {
+			deliveries = append(deliveries, *wd)
+		}
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt) })
+
+	return deliveries
+}
+
+// notify sends a delivery event for msg to the subscribed webhooks.
+func (app *application) notify(event string, msg *message, recipients []string) {
+	ev := webhookEvent{
+		Event:      event,
+		MessageID:  msg.ID,
+		Template:   msg.Template,
+		Recipients: recipients,
+		Attempts:   msg.Attempts,
+		At:         time.Now().UTC(),
+	}
+
+	if event != eventSent {
+		ev.Response = msg.LastError
+	}
+
+	if event == eventDeferred {
+		next := msg.NextAttempt
+		ev.NextAttempt = &next
+	}
+
+	app.webhooks.dispatch(ev)
+}